@@ -0,0 +1,33 @@
+package main
+
+import (
+	"expvar"
+	"net/http/pprof"
+
+	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/go-chi/chi/v5"
+)
+
+// getDebugRoutes serves the Prometheus metrics and the expvar and pprof
+// handlers. They go on their own listener, bound to -debug-addr, so they are
+// never reachable through the public port and its middleware.
+func getDebugRoutes(app *config.Application) *chi.Mux {
+	app.PublishExpvars()
+
+	r := chi.NewMux()
+
+	r.Use(app.RecoverPanic)
+	r.Use(app.DebugAuth)
+	r.NotFound(app.NotFoundResponse)
+
+	r.Get("/metrics", metricsHandlerGet(app)) //Prometheus scrape endpoint
+	r.Handle("/debug/vars", expvar.Handler())
+
+	r.HandleFunc("/debug/pprof/*", pprof.Index) //Named profiles such as heap and goroutine
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return r
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
+)
+
+const (
+	exportBatchSize   = 500
+	exportWriteWindow = 30 * time.Second
+)
+
+// movieEncoder writes an export in a particular format. Begin and End frame
+// the document, Write is called once per batch fetched from the database.
+type movieEncoder interface {
+	Begin() error
+	Write(movies []*data.Movie) error
+	End() error
+}
+
+var exportContentTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+	"json":   "application/json",
+}
+
+func exportMoviesHandlerGet(app *config.Application) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var input struct {
+			data.MovieFilter
+			Format string
+		}
+
+		v := validator.NewValidator()
+
+		qs := r.URL.Query()
+
+		input.MovieFilter = readMovieFilter(app, qs, v)
+		input.Format = app.ReadStrings(qs, "format", exportFormatFromAccept(r.Header.Get("Accept")))
+
+		exportFormats := []string{"csv", "ndjson", "json"}
+		v.Check(validator.In(input.Format, exportFormats...), "format", validator.CodeNotAllowed, validator.Params{"value": input.Format, "allowed": exportFormats})
+
+		data.ValidateMovieFilter(v, input.MovieFilter)
+
+		if !v.Valid() {
+			app.FailedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		var enc movieEncoder
+		switch input.Format {
+		case "csv":
+			enc = &csvMovieEncoder{w: csv.NewWriter(w)}
+		case "ndjson":
+			enc = &ndjsonMovieEncoder{enc: json.NewEncoder(w)}
+		default:
+			enc = &jsonMovieEncoder{w: w}
+		}
+
+		rc := http.NewResponseController(w)
+
+		// Headers are held back until the first batch arrives so that a query that
+		// fails straight away still gets a proper error response.
+		started := false
+		start := func() error {
+			started = true
+
+			w.Header().Set("Content-Type", exportContentTypes[input.Format])
+			w.Header().Set("Content-Disposition", `attachment; filename="movies.`+input.Format+`"`)
+			w.WriteHeader(http.StatusOK)
+
+			return enc.Begin()
+		}
+
+		err := app.Models.Movies.Export(r.Context(), input.MovieFilter, exportBatchSize, func(movies []*data.Movie) error {
+			if !started {
+				err := start()
+				if err != nil {
+					return err
+				}
+			}
+
+			// Every batch buys the export another write window, the server-wide
+			// WriteTimeout would otherwise cut off large catalogs.
+			err := rc.SetWriteDeadline(time.Now().Add(exportWriteWindow))
+			if err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+
+			err = enc.Write(movies)
+			if err != nil {
+				return err
+			}
+
+			err = rc.Flush()
+			if errors.Is(err, http.ErrNotSupported) {
+				return nil
+			}
+			return err
+		})
+		if err != nil && !started {
+			app.InternalSErrorResponse(w, r, err)
+			return
+		}
+
+		if err == nil && !started {
+			err = start()
+		}
+		if err == nil {
+			err = enc.End()
+		}
+
+		// The status line is already gone at this point, so the best we can do is
+		// log the failure and let the client notice the truncated document.
+		if err != nil {
+			app.ErrLog(r, err)
+		}
+	}
+}
+
+// exportFormatFromAccept picks the first export format named in the Accept
+// header, falling back to json when none of them is listed.
+func exportFormatFromAccept(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediatype, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		switch mediatype {
+		case "text/csv":
+			return "csv"
+		case "application/x-ndjson", "application/ndjson":
+			return "ndjson"
+		case "application/json":
+			return "json"
+		}
+	}
+	return "json"
+}
+
+type csvMovieEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvMovieEncoder) Begin() error {
+	return e.w.Write([]string{"id", "created_at", "title", "year", "runtime", "genres", "version"})
+}
+
+func (e *csvMovieEncoder) Write(movies []*data.Movie) error {
+	for _, movie := range movies {
+		err := e.w.Write([]string{
+			strconv.FormatInt(movie.ID, 10),
+			movie.CreatedAt.Format(time.RFC3339),
+			movie.Title,
+			strconv.Itoa(int(movie.Year)),
+			strconv.Itoa(int(movie.Runtime)),
+			strings.Join(movie.Genres, "|"),
+			strconv.Itoa(int(movie.Version)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvMovieEncoder) End() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonMovieEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonMovieEncoder) Begin() error {
+	return nil
+}
+
+func (e *ndjsonMovieEncoder) Write(movies []*data.Movie) error {
+	for _, movie := range movies {
+		err := e.enc.Encode(movie)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ndjsonMovieEncoder) End() error {
+	return nil
+}
+
+// jsonMovieEncoder writes the same {"movies": [...]} envelope as the list
+// endpoint, one element at a time instead of marshalling the whole slice.
+type jsonMovieEncoder struct {
+	w       io.Writer
+	written bool
+}
+
+func (e *jsonMovieEncoder) Begin() error {
+	_, err := io.WriteString(e.w, "{\"movies\": [")
+	return err
+}
+
+func (e *jsonMovieEncoder) Write(movies []*data.Movie) error {
+	for _, movie := range movies {
+		js, err := json.Marshal(movie)
+		if err != nil {
+			return err
+		}
+
+		separator := ",\n"
+		if !e.written {
+			separator = "\n"
+			e.written = true
+		}
+
+		_, err = io.WriteString(e.w, separator)
+		if err != nil {
+			return err
+		}
+
+		_, err = e.w.Write(js)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *jsonMovieEncoder) End() error {
+	_, err := io.WriteString(e.w, "\n]}\n")
+	return err
+}
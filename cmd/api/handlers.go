@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
@@ -22,48 +23,77 @@ func healthcheckhandler(app *config.Application) http.HandlerFunc {
 			},
 		}
 
-		err := app.JsonWriter(w, http.StatusOK, *envelope, nil)
+		if app.Models.DB != nil {
+			(*envelope)["db_pool"] = dbPoolStats(app.Models.DB.Stats())
+		}
+
+		err := app.JsonWriter(w, r, http.StatusOK, *envelope, nil)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 		}
 	}
 }
 
+// dbPoolStats reports how saturated the connection pool is: a growing
+// wait_count means requests queue for a connection and -db-max-open-conns is
+// too low for the load.
+func dbPoolStats(stats sql.DBStats) map[string]interface{} {
+	return map[string]interface{}{
+		"max_open_connections": stats.MaxOpenConnections,
+		"open_connections":     stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"wait_count":           stats.WaitCount,
+		"wait_duration":        stats.WaitDuration.String(),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_idle_time_closed": stats.MaxIdleTimeClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+	}
+}
+
 func listMoviesHandlerGet(app *config.Application) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		var input struct {
-			Title  string
-			Genres []string
+			data.MovieFilter
 			data.Filters
+			Fields []string
 		}
 
 		v := validator.NewValidator()
 
 		qs := r.URL.Query()
 
-		input.Title = app.ReadStrings(qs, "title", "")
-		input.Genres = app.ReadCSV(qs, "genres", []string{})
+		input.MovieFilter = readMovieFilter(app, qs, v)
 
 		input.Filters.Page = app.ReadInt(qs, "page", 1, v)
 		input.Filters.PageSize = app.ReadInt(qs, "page_size", 20, v)
 
-		input.Filters.Sort = app.ReadStrings(qs, "sort", "id")
+		input.Filters.Sort = app.ReadCSV(qs, "sort", []string{"id"})
+
+		input.Filters.Cursor = app.ReadStrings(qs, "cursor", "")
+		input.Filters.CursorSecret = []byte(app.Config.Pagination.CursorSecret)
+		input.Filters.IncludeTotal = app.ReadBool(qs, "include_total", input.Filters.Cursor == "", v)
 
 		input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
 
+		input.Fields = app.ReadCSV(qs, "fields", []string{})
+
+		data.ValidateMovieFilter(v, input.MovieFilter)
+		data.ValidateFields(v, input.Fields, data.MovieFieldSafeList)
+
 		if data.ValidateFilters(v, input.Filters); !v.Valid() {
 			app.FailedValidationResponse(w, r, v.Errors)
 			return
 		}
 
-		movies, metadata, err := app.Models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+		movies, metadata, err := app.Models.Movies.GetAll(r.Context(), input.MovieFilter, input.Filters, input.Fields)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
 		}
 
-		err = app.JsonWriter(w, http.StatusOK, config.Envelope{"metadata": metadata, "movies": movies}, nil)
+		err = app.JsonWriter(w, r, http.StatusOK, config.Envelope{"metadata": metadata, "movies": config.Sparse{Value: movies, Fields: input.Fields}}, nil)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 		}
@@ -71,6 +101,95 @@ func listMoviesHandlerGet(app *config.Application) http.HandlerFunc {
 	}
 }
 
+func searchMoviesHandlerGet(app *config.Application) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var input struct {
+			data.SearchQuery
+			data.Filters
+		}
+
+		v := validator.NewValidator()
+
+		qs := r.URL.Query()
+
+		input.SearchQuery.Query = app.ReadStrings(qs, "q", "")
+		input.SearchQuery.Config = app.ReadStrings(qs, "lang", app.Config.Search.Config)
+		input.SearchQuery.Prefix = app.ReadBool(qs, "prefix", false, v)
+
+		input.Filters.Page = app.ReadInt(qs, "page", 1, v)
+		input.Filters.PageSize = app.ReadInt(qs, "page_size", 20, v)
+
+		// Results are always ordered by rank, the sort only has to pass validation.
+		input.Filters.Sort = []string{"rank"}
+		input.Filters.SortSafeList = []string{"rank"}
+
+		data.ValidateSearchQuery(v, input.SearchQuery)
+
+		if data.ValidateFilters(v, input.Filters); !v.Valid() {
+			app.FailedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		results, metadata, err := app.Models.Movies.Search(r.Context(), input.SearchQuery, input.Filters)
+		if err != nil {
+			app.InternalSErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.JsonWriter(w, r, http.StatusOK, config.Envelope{"metadata": metadata, "results": results}, nil)
+		if err != nil {
+			app.InternalSErrorResponse(w, r, err)
+		}
+	}
+}
+
+func autocompleteMoviesHandlerGet(app *config.Application) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		v := validator.NewValidator()
+
+		qs := r.URL.Query()
+
+		q := app.ReadStrings(qs, "q", "")
+		limit := app.ReadInt(qs, "limit", 10, v)
+
+		if data.ValidateAutocomplete(v, q, limit); !v.Valid() {
+			app.FailedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		suggestions, err := app.Models.Movies.Autocomplete(r.Context(), q, limit)
+		if err != nil {
+			app.InternalSErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.JsonWriter(w, r, http.StatusOK, config.Envelope{"suggestions": suggestions}, nil)
+		if err != nil {
+			app.InternalSErrorResponse(w, r, err)
+		}
+	}
+}
+
+// readMovieFilter reads the row filters shared by the listing and export
+// endpoints from the query string.
+func readMovieFilter(app *config.Application, qs url.Values, v *validator.Validator) data.MovieFilter {
+	return data.MovieFilter{
+		Title:         app.ReadStrings(qs, "title", ""),
+		Fuzzy:         app.ReadBool(qs, "fuzzy", false, v),
+		Genres:        app.ReadCSV(qs, "genres", []string{}),
+		GenresAny:     app.ReadCSV(qs, "genres_any", []string{}),
+		GenresExclude: app.ReadCSV(qs, "genres_exclude", []string{}),
+		YearMin:       app.ReadOptionalInt(qs, "year_min", v),
+		YearMax:       app.ReadOptionalInt(qs, "year_max", v),
+		RuntimeMin:    app.ReadOptionalInt(qs, "runtime_min", v),
+		RuntimeMax:    app.ReadOptionalInt(qs, "runtime_max", v),
+		CreatedAfter:  app.ReadTime(qs, "created_after", v),
+		CreatedBefore: app.ReadTime(qs, "created_before", v),
+	}
+}
+
 func showMoviesHandlerGet(app *config.Application) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := app.ReadIDparameter(w, r)
@@ -79,10 +198,19 @@ func showMoviesHandlerGet(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		movie, err := app.Models.Movies.Get(id)
+		v := validator.NewValidator()
+
+		fields := app.ReadCSV(r.URL.Query(), "fields", []string{})
+
+		if data.ValidateFields(v, fields, data.MovieFieldSafeList); !v.Valid() {
+			app.FailedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		movie, err := app.Models.Movies.Get(r.Context(), id, fields)
 		if err != nil {
 			switch {
-			case errors.Is(err, sql.ErrNoRows):
+			case errors.Is(err, data.ErrRecordNotFound):
 				app.NotFoundResponse(w, r)
 			default:
 				app.InternalSErrorResponse(w, r, err)
@@ -90,7 +218,7 @@ func showMoviesHandlerGet(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		err = app.JsonWriter(w, http.StatusOK, config.Envelope{"movie": movie}, nil)
+		err = app.JsonWriter(w, r, http.StatusOK, config.Envelope{"movie": config.Sparse{Value: movie, Fields: fields}}, nil)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 		}
@@ -164,7 +292,7 @@ func createMovieHandlerPost(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		err = app.Models.Movies.Insert(movie)
+		err = app.Models.Movies.Insert(r.Context(), movie)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
@@ -173,7 +301,7 @@ func createMovieHandlerPost(app *config.Application) http.HandlerFunc {
 		headers := make(http.Header)
 		headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
 
-		err = app.JsonWriter(w, http.StatusOK, config.Envelope{"movie": movie}, headers)
+		err = app.JsonWriter(w, r, http.StatusOK, config.Envelope{"movie": movie}, headers)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
@@ -190,10 +318,10 @@ func movieupdateHandlerDelete(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		err = app.Models.Movies.Delete(id)
+		err = app.Models.Movies.Delete(r.Context(), id)
 		if err != nil {
 			switch {
-			case errors.Is(err, sql.ErrNoRows):
+			case errors.Is(err, data.ErrRecordNotFound):
 				app.NotFoundResponse(w, r)
 			default:
 				app.InternalSErrorResponse(w, r, err)
@@ -201,7 +329,7 @@ func movieupdateHandlerDelete(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		err = app.JsonWriter(w, http.StatusOK, config.Envelope{"movie": fmt.Sprintf("movie at id %v deleted succesfully", id)}, nil)
+		err = app.JsonWriter(w, r, http.StatusOK, config.Envelope{"movie": fmt.Sprintf("movie at id %v deleted succesfully", id)}, nil)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 		}
@@ -229,10 +357,10 @@ func movielistHandlerPatch(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		movie, err := app.Models.Movies.Get(id)
+		movie, err := app.Models.Movies.Get(r.Context(), id, nil)
 		if err != nil {
 			switch {
-			case errors.Is(err, sql.ErrNoRows):
+			case errors.Is(err, data.ErrRecordNotFound):
 				app.NotFoundResponse(w, r)
 			default:
 				app.InternalSErrorResponse(w, r, err)
@@ -260,9 +388,10 @@ func movielistHandlerPatch(app *config.Application) http.HandlerFunc {
 
 		if data.ValidateMovie(v, movie); !v.Valid() {
 			app.FailedValidationResponse(w, r, v.Errors)
+			return
 		}
 
-		err = app.Models.Movies.Update(movie)
+		err = app.Models.Movies.Update(r.Context(), movie)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrEditConflict):
@@ -276,7 +405,7 @@ func movielistHandlerPatch(app *config.Application) http.HandlerFunc {
 		headers := make(http.Header)
 		headers.Set("location", fmt.Sprintf("/v1/movies/%d", id))
 
-		err = app.JsonWriter(w, http.StatusOK, config.Envelope{"movie": movie}, headers)
+		err = app.JsonWriter(w, r, http.StatusOK, config.Envelope{"movie": movie}, headers)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
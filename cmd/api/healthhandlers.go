@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/metrics"
+)
+
+// dependencyCheck is the outcome of probing one dependency for readiness.
+type dependencyCheck struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// checkDependency runs probe with the readiness timeout. Probes that cannot
+// take a context, like dialing SMTP, are abandoned rather than waited on once
+// the timeout passes.
+func checkDependency(ctx context.Context, timeout time.Duration, probe func(ctx context.Context) error) dependencyCheck {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+
+	go func() {
+		done <- probe(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	check := dependencyCheck{Status: "up", Latency: time.Since(start).String()}
+	if err != nil {
+		check.Status = "down"
+		check.Error = err.Error()
+	}
+
+	return check
+}
+
+// liveHandlerGet only says the process is serving requests. It deliberately
+// ignores dependencies so an orchestrator does not restart the API because
+// Postgres is down.
+func liveHandlerGet(app *config.Application) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := app.JsonWriter(w, r, http.StatusOK, config.Envelope{"status": "alive"}, nil)
+		if err != nil {
+			app.InternalSErrorResponse(w, r, err)
+		}
+	}
+}
+
+// readyHandlerGet reports whether the API can serve traffic: every dependency
+// answers within -health-timeout and the server is not shutting down.
+func readyHandlerGet(app *config.Application) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		probes := map[string]func(ctx context.Context) error{}
+
+		if app.Models.DB != nil {
+			probes["database"] = app.Models.DB.PingContext
+		}
+
+		if app.Config.Health.CheckSMTP {
+			probes["smtp"] = func(ctx context.Context) error {
+				return app.Mailer.Ping()
+			}
+		}
+
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			checks = map[string]dependencyCheck{}
+		)
+
+		for name, probe := range probes {
+			wg.Add(1)
+			go func(name string, probe func(ctx context.Context) error) {
+				defer wg.Done()
+
+				check := checkDependency(r.Context(), app.Config.Health.Timeout, probe)
+
+				mu.Lock()
+				checks[name] = check
+				mu.Unlock()
+			}(name, probe)
+		}
+
+		wg.Wait()
+
+		status := "ready"
+		for _, check := range checks {
+			if check.Status != "up" {
+				status = "not_ready"
+			}
+		}
+
+		if app.ShuttingDown.Load() {
+			status = "shutting_down"
+		}
+
+		code := http.StatusOK
+		if status != "ready" {
+			code = http.StatusServiceUnavailable
+		}
+
+		err := app.JsonWriter(w, r, code, config.Envelope{"status": status, "checks": checks}, nil)
+		if err != nil {
+			app.InternalSErrorResponse(w, r, err)
+		}
+	}
+}
+
+// metricsHandlerGet exposes the counters in the Prometheus text format.
+func metricsHandlerGet(app *config.Application) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metrics.ContentType)
+
+		_, err := app.Metrics.WriteTo(w)
+		if err != nil {
+			app.ErrLog(r, err)
+		}
+	}
+}
@@ -2,19 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/jsonlog"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/migrate"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
+	"github.com/3WDeveloper-GM/json-endpoints/migrations"
 )
 
 const version = "1.0.0"
 
-var appcfg, applog, appmodel, appsmtp, db = initConfig()
-
 // initializes the configuration struct at runtime.
 func initConfig() (*config.AppConfig, *config.AppLoggers, *config.AppModels, *config.AppSMTP, *sql.DB) {
 
@@ -29,51 +37,224 @@ func initConfig() (*config.AppConfig, *config.AppLoggers, *config.AppModels, *co
 	flag.Parse()
 	applog.PrintInfo("config object correctly configured", nil)
 
+	if appcfg.Pagination.CursorSecret == "" {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			applog.PrintFatal(err, nil)
+		}
+		appcfg.Pagination.CursorSecret = hex.EncodeToString(secret)
+		applog.PrintInfo("no cursor secret configured, pagination cursors will not survive a restart", nil)
+	}
+
+	if appcfg.CORS.AllowCredentials && validator.In("*", appcfg.CORS.TrustedOrigins...) {
+		applog.PrintFatal(errors.New("-cors-allow-credentials cannot be combined with the \"*\" trusted origin, list the origins instead"), nil)
+	}
+
+	if appcfg.Debug.Addr != "" && appcfg.Debug.Username == "" && !config.LoopbackAddr(appcfg.Debug.Addr) {
+		applog.PrintFatal(fmt.Errorf("-debug-addr %q is not a loopback address, set -debug-username to expose the admin listener", appcfg.Debug.Addr), nil)
+	}
+
+	if !validator.In(appcfg.Search.Config, data.SearchConfigSafeList...) {
+		applog.PrintFatal(fmt.Errorf("unsupported -search-config %q", appcfg.Search.Config), nil)
+	}
+
+	err := setupTracing(appcfg, applog)
+	if err != nil {
+		applog.PrintFatal(err, nil)
+	}
+
 	//smtp third
 	appsmtp := &config.AppSMTP{}
 	appsmtp.SetStructConfig(appcfg)
 	applog.PrintInfo("SMTP mailer object initialized", nil)
 
 	//finally DB and models
-	db, err := openDB(appcfg)
-	if err != nil {
-		applog.PrintFatal(err, nil)
+	appmodel := &config.AppModels{}
+
+	var db *sql.DB
+
+	switch appcfg.Storage {
+	case "memory":
+		appmodel.SetMemoryConfig()
+		applog.PrintInfo("in-memory storage initialized, data will not survive a restart", nil)
+	case "postgres":
+		var err error
+		db, err = openDB(appcfg, applog)
+		if err != nil {
+			applog.PrintFatal(err, nil)
+		}
+
+		applog.PrintInfo("database connection pool established", nil)
+
+		if appcfg.Database.MigrateOnStart {
+			err = migrateDB(db, applog)
+			if err != nil {
+				applog.PrintFatal(err, nil)
+			}
+		}
+
+		appmodel.SetStructConfig(db, appcfg)
+	default:
+		applog.PrintFatal(fmt.Errorf("unsupported -storage %q", appcfg.Storage), nil)
 	}
 
-	appmodel := &config.AppModels{}
-	appmodel.SetStructConfig(db)
-	applog.PrintInfo("database connection pool established", nil)
+	switch {
+	case !validator.In(appcfg.Limiter.Store, "local", "postgres"):
+		applog.PrintFatal(fmt.Errorf("unsupported -limiter-store %q", appcfg.Limiter.Store), nil)
+	case appcfg.Limiter.Store == "postgres" && db == nil:
+		applog.PrintFatal(errors.New("-limiter-store postgres needs -storage postgres"), nil)
+	}
 
 	return appcfg, applog, appmodel, appsmtp, db
 }
 
 func main() {
 
-	defer db.Close()             //deferring the database shutdown when the program terminates
+	appcfg, applog, appmodel, appsmtp, db := initConfig()
+
+	if db != nil {
+		defer db.Close() //deferring the database shutdown when the program terminates
+	}
 	app := &config.Application{} //Getting an application struct
 
-	app.SetStructConfig(appcfg, applog, appmodel, appsmtp)   //configuring the app struct in a single data structure
-	applog.PrintInfo("Application object initialized.", nil) //confirmation message
+	appmetrics := &config.AppMetrics{}
+	appmetrics.SetStructConfig(db)
+
+	applimiter := &config.AppLimiter{}
+	applimiter.SetStructConfig(appcfg, db, applog, appmetrics)
+
+	app.SetStructConfig(appcfg, applog, appmodel, appsmtp, appmetrics, applimiter) //configuring the app struct in a single data structure
+	applog.PrintInfo("Application object initialized.", nil)                       //confirmation message
 
 	err := serve(app)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if terr := tracing.Shutdown(ctx); terr != nil {
+		applog.PrintError(terr, nil)
+	}
+
 	if err != nil {
 		applog.PrintFatal(err, nil)
 	}
 }
 
-func openDB(appcfg *config.AppConfig) (*sql.DB, error) {
+// setupTracing installs the span exporter picked with -trace-exporter.
+func setupTracing(appcfg *config.AppConfig, applog *config.AppLoggers) error {
+	service := appcfg.Tracing.ServiceName
+
+	switch appcfg.Tracing.Exporter {
+	case "none":
+		return nil
+	case "stdout":
+		tracing.SetExporter(tracing.NewWriterExporter(os.Stdout, service))
+	case "file":
+		exporter, err := tracing.NewFileExporter(appcfg.Tracing.File, service)
+		if err != nil {
+			return err
+		}
+		tracing.SetExporter(exporter)
+	case "otlp":
+		exporter := tracing.NewOTLPExporter(appcfg.Tracing.OTLPEndpoint, service)
+		exporter.OnError = func(err error) {
+			applog.PrintError(err, map[string]string{"exporter": "otlp"})
+		}
+		tracing.SetExporter(exporter)
+	default:
+		return fmt.Errorf("unsupported -trace-exporter %q", appcfg.Tracing.Exporter)
+	}
+
+	applog.PrintInfo("tracing enabled", map[string]string{"exporter": appcfg.Tracing.Exporter})
+	return nil
+}
+
+// openDB configures the connection pool and waits for Postgres to accept
+// connections, retrying with exponential backoff for up to
+// -db-connect-timeout so the API can start alongside a database that is still
+// booting.
+func openDB(appcfg *config.AppConfig, applog *config.AppLoggers) (*sql.DB, error) {
 	db, err := sql.Open("postgres", appcfg.Database.Dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	db.SetMaxOpenConns(appcfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(appcfg.Database.MaxIdleConns)
+
+	idleTime, err := time.ParseDuration(appcfg.Database.MaxIdleTime)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid -db-max-idle-time: %w", err)
+	}
+	db.SetConnMaxIdleTime(idleTime)
+
+	lifetime, err := time.ParseDuration(appcfg.Database.MaxLifetime)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid -db-max-lifetime: %w", err)
+	}
+	db.SetConnMaxLifetime(lifetime)
+
+	deadline := time.Now().Add(appcfg.Database.ConnectTimeout)
+	backoff := 250 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = db.PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			return db, nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			db.Close()
+			return nil, fmt.Errorf("database unreachable after %d attempts: %w", attempt, err)
+		}
+
+		applog.PrintInfo("database not ready, retrying", map[string]string{
+			"attempt": strconv.Itoa(attempt),
+			"backoff": backoff.String(),
+			"error":   err.Error(),
+		})
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > 8*time.Second {
+			backoff = 8 * time.Second
+		}
+	}
+}
+
+// migrateDB brings the schema up to date before the server starts. The runner
+// holds an advisory lock, so replicas starting together apply each migration
+// only once.
+func migrateDB(db *sql.DB, applog *config.AppLoggers) error {
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	err = db.PingContext(ctx)
+	applied, err := migrator.Up(ctx)
+	for _, migration := range applied {
+		applog.PrintInfo("migration applied", map[string]string{
+			"version": strconv.FormatInt(migration.Version, 10),
+			"name":    migration.Name,
+		})
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return db, nil
+	applog.PrintInfo("database schema up to date", map[string]string{
+		"version": strconv.FormatInt(migrator.Latest(), 10),
+	})
+
+	return nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/jsonlog"
+)
+
+// unreachableDSN points at a port nothing listens on, so every ping is
+// refused straight away and openDB's timing is all backoff.
+func unreachableDSN(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	return fmt.Sprintf("postgres://greenlight:pa55word@%s/greenlight?sslmode=disable", addr)
+}
+
+func newTestDBConfig(dsn string, connectTimeout time.Duration) *config.AppConfig {
+	appcfg := &config.AppConfig{}
+	appcfg.Database.Dsn = dsn
+	appcfg.Database.MaxOpenConns = 5
+	appcfg.Database.MaxIdleConns = 5
+	appcfg.Database.MaxIdleTime = "1m"
+	appcfg.Database.MaxLifetime = "1h"
+	appcfg.Database.ConnectTimeout = connectTimeout
+	return appcfg
+}
+
+func TestOpenDBGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		attempts int
+		backoffs []string
+		slept    time.Duration
+	}{
+		{name: "no retries", timeout: 0, attempts: 1},
+		{name: "backoff doubles", timeout: time.Second, attempts: 3, backoffs: []string{"250ms", "500ms"}, slept: 750 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			applog := &config.AppLoggers{}
+			applog.SetStructConfig(&logs, jsonlog.LevelInfo)
+
+			start := time.Now()
+			db, err := openDB(newTestDBConfig(unreachableDSN(t), tt.timeout), applog)
+			elapsed := time.Since(start)
+
+			if err == nil {
+				db.Close()
+				t.Fatal("connected to an unreachable database")
+			}
+
+			want := fmt.Sprintf("database unreachable after %d attempts", tt.attempts)
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %q, want it to contain %q", err, want)
+			}
+
+			// Gives up before sleeping past the deadline rather than after.
+			if elapsed < tt.slept || elapsed > tt.timeout+time.Second {
+				t.Errorf("took %s with a connect timeout of %s, want at least %s", elapsed, tt.timeout, tt.slept)
+			}
+
+			var backoffs []string
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if line == "" {
+					continue
+				}
+				var entry struct {
+					Message    string            `json:"message"`
+					Properties map[string]string `json:"properties"`
+				}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("log line %q: %v", line, err)
+				}
+				if entry.Message == "database not ready, retrying" {
+					backoffs = append(backoffs, entry.Properties["backoff"])
+				}
+			}
+
+			if strings.Join(backoffs, ",") != strings.Join(tt.backoffs, ",") {
+				t.Errorf("got backoffs %v, want %v", backoffs, tt.backoffs)
+			}
+		})
+	}
+}
+
+func TestOpenDBInvalidConfig(t *testing.T) {
+	applog := &config.AppLoggers{}
+	applog.SetStructConfig(&bytes.Buffer{}, jsonlog.LevelOff)
+
+	appcfg := newTestDBConfig(unreachableDSN(t), time.Second)
+	appcfg.Database.MaxIdleTime = "a while"
+
+	start := time.Now()
+	_, err := openDB(appcfg, applog)
+	if err == nil || !strings.Contains(err.Error(), "invalid -db-max-idle-time") {
+		t.Errorf("got error %v, want an invalid -db-max-idle-time error", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("took %s to reject the configuration, want no connection attempts", elapsed)
+	}
+}
+
+func TestOpenDBConnects(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+
+	var logs bytes.Buffer
+	applog := &config.AppLoggers{}
+	applog.SetStructConfig(&logs, jsonlog.LevelInfo)
+
+	db, err := openDB(newTestDBConfig(dsn, time.Second), applog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if strings.Contains(logs.String(), "retrying") {
+		t.Errorf("retried a reachable database: %s", logs.String())
+	}
+}
@@ -2,34 +2,52 @@ package main
 
 import (
 	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/ratelimit"
 	"github.com/go-chi/chi/v5"
 )
 
 func getRoutes(app *config.Application) *chi.Mux {
 	r := chi.NewMux()
 
+	r.Use(app.RequestID)
+	r.Use(app.Compress)
+	r.Use(app.RecordMetrics)
+	r.Use(app.Trace)
 	r.Use(app.RouteLogger)
 	r.Use(app.RecoverPanic)
-	r.Use(app.RateLimiter)
+	r.Use(app.EnableCORS)
+	r.Use(app.RateLimitIP)
 	r.Use(app.Authenticate)
+	r.Use(app.RateLimitUser)
+	r.Use(app.Idempotent)
 	r.NotFound(app.NotFoundResponse)
 
 	r.MethodNotAllowed(app.MethodNAResponse)
 
+	// Everything but the export, which picks its own formats, speaks JSON,
+	// MessagePack and CBOR.
+	api := r.With(app.Negotiate(config.CodecMediaTypes()...))
+
 	// GET routes
-	r.Get("/v1/healthcheck", healthcheckhandler(app))                            //Display application information in JSON
-	r.Get("/v1/movies", app.RequireActivatedUsr(listMoviesHandlerGet(app)))      //Display a list of movies in the DB
-	r.Get("/v1/movies/{id}", app.RequireActivatedUsr(showMoviesHandlerGet(app))) //Display a particular movie in the DB
+	api.Get("/v1/healthcheck", healthcheckhandler(app))                                            //Display application information in JSON
+	api.Get("/v1/health/live", liveHandlerGet(app))                                                //The process is up and serving requests
+	api.Get("/v1/health/ready", readyHandlerGet(app))                                              //Dependencies answer and the server is not shutting down
+	api.Get("/v1/movies", app.RequireActivatedUsr(listMoviesHandlerGet(app)))                      //Display a list of movies in the DB
+	r.Get("/v1/movies/export", app.RequireActivatedUsr(exportMoviesHandlerGet(app)))               //Stream every matching movie as CSV, NDJSON or JSON
+	api.Get("/v1/movies/search", app.RequireActivatedUsr(searchMoviesHandlerGet(app)))             //Ranked full-text search with highlighted titles
+	api.Get("/v1/movies/autocomplete", app.RequireActivatedUsr(autocompleteMoviesHandlerGet(app))) //Closest titles for type-ahead, tolerant of typos
+	api.Get("/v1/movies/{id}", app.RequireActivatedUsr(showMoviesHandlerGet(app)))                 //Display a particular movie in the DB
 
-	r.Post("/v1/movies", app.RequireActivatedUsr(createMovieHandlerPost(app))) //Add some movie to the DB using a JSON request body
-	r.Post("/v1/users", userRegisterPost(app))                                 //Add user to the DB using a JSON request body
-	r.Post("/v1/users/authentication", createAuthenticationTokenPost(app))
+	api.Post("/v1/movies", app.RequireActivatedUsr(createMovieHandlerPost(app))) //Add some movie to the DB using a JSON request body
+	api.Post("/v1/users", userRegisterPost(app))                                 //Add user to the DB using a JSON request body
+	api.With(app.RouteRateLimit("authentication", ratelimit.Rule{Rps: app.Config.Limiter.AuthRps, Burst: app.Config.Limiter.AuthBurst})).
+		Post("/v1/users/authentication", createAuthenticationTokenPost(app)) //Stricter limit against password guessing
 
-	r.Patch("/v1/movies/{id}", app.RequireActivatedUsr(movielistHandlerPatch(app))) //Patching some of the resources in the DB
+	api.Patch("/v1/movies/{id}", app.RequireActivatedUsr(movielistHandlerPatch(app))) //Patching some of the resources in the DB
 
-	r.Delete("/v1/movies/{id}", app.RequireActivatedUsr(movieupdateHandlerDelete(app))) //Deleting an entry in the DB
+	api.Delete("/v1/movies/{id}", app.RequireActivatedUsr(movieupdateHandlerDelete(app))) //Deleting an entry in the DB
 
-	r.Put("/v1/users/activated", activateUserPut(app))
+	api.Put("/v1/users/activated", activateUserPut(app))
 
 	return r
 }
@@ -0,0 +1,1684 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/codec"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/jsonlog"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
+)
+
+func TestHealthcheck(t *testing.T) {
+	ts := newTestServer(t)
+
+	res := ts.do(t, http.MethodGet, "/v1/healthcheck", nil, "")
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.status, http.StatusOK)
+	}
+
+	if status := res.decode(t)["status"]; status != "available" {
+		t.Errorf("got status %q, want %q", status, "available")
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	tests := []struct {
+		name         string
+		checkSMTP    bool
+		shuttingDown bool
+		path         string
+		status       int
+		wantStatus   string
+	}{
+		{name: "live", path: "/v1/health/live", status: http.StatusOK, wantStatus: "alive"},
+		{name: "live while shutting down", shuttingDown: true, path: "/v1/health/live", status: http.StatusOK, wantStatus: "alive"},
+		{name: "ready", path: "/v1/health/ready", status: http.StatusOK, wantStatus: "ready"},
+		{name: "smtp unreachable", checkSMTP: true, path: "/v1/health/ready", status: http.StatusServiceUnavailable, wantStatus: "not_ready"},
+		{name: "shutting down", shuttingDown: true, path: "/v1/health/ready", status: http.StatusServiceUnavailable, wantStatus: "shutting_down"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, func(appcfg *config.AppConfig) {
+				appcfg.Health.CheckSMTP = tt.checkSMTP
+			})
+			ts.app.ShuttingDown.Store(tt.shuttingDown)
+
+			res := ts.do(t, http.MethodGet, tt.path, nil, "")
+			if res.status != tt.status {
+				t.Errorf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+
+			body := res.decode(t)
+			if body["status"] != tt.wantStatus {
+				t.Errorf("got status %q, want %q", body["status"], tt.wantStatus)
+			}
+
+			if tt.checkSMTP {
+				smtp := body["checks"].(map[string]interface{})["smtp"].(map[string]interface{})
+				if smtp["status"] != "down" || smtp["error"] == "" {
+					t.Errorf("smtp check not reported as down: %v", smtp)
+				}
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t, func(appcfg *config.AppConfig) {
+		appcfg.Limiter.Enabled = true
+		appcfg.Limiter.Rps = 0.1
+		appcfg.Limiter.Burst = 3
+	})
+
+	ts.do(t, http.MethodGet, "/v1/movies/1", nil, "")
+	ts.do(t, http.MethodGet, "/v1/movies/2", nil, "")
+	ts.do(t, http.MethodGet, "/v1/healthcheck", nil, "")
+	ts.do(t, http.MethodGet, "/v1/healthcheck", nil, "")
+
+	ts.app.Config.Limiter.Enabled = false
+
+	ts.do(t, "BREW", "/v1/healthcheck", nil, "")
+
+	if res := ts.do(t, http.MethodGet, "/metrics", nil, ""); res.status != http.StatusNotFound {
+		t.Errorf("metrics on the public listener: got status %d, want %d", res.status, http.StatusNotFound)
+	}
+
+	debug := &testServer{Server: newHTTPTestServer(t, getDebugRoutes(ts.app)), app: ts.app}
+
+	res := debug.do(t, http.MethodGet, "/metrics", nil, "")
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.status, http.StatusOK)
+	}
+
+	if ct := res.header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", ct)
+	}
+
+	for _, line := range []string{
+		`http_requests_total{route="/v1/movies/{id}",method="GET",status="401"} 2`,
+		`http_requests_total{route="/v1/healthcheck",method="GET",status="200"} 1`,
+		`http_request_duration_seconds_count{route="/v1/movies/{id}",method="GET",status="401"} 2`,
+		`http_requests_in_flight 0`,
+		`ratelimit_rejections_total 1`,
+	} {
+		if !strings.Contains(string(res.body), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, res.body)
+		}
+	}
+
+	if !strings.Contains(string(res.body), `method="OTHER"`) || strings.Contains(string(res.body), "BREW") {
+		t.Errorf("unknown method not labelled OTHER:\n%s", res.body)
+	}
+}
+
+func TestDebugListener(t *testing.T) {
+	app, _ := newTestApplication(t, func(appcfg *config.AppConfig) {
+		appcfg.Debug.Username = "admin"
+		appcfg.Debug.Password = "s3cret"
+	})
+
+	ts := &testServer{Server: newHTTPTestServer(t, getDebugRoutes(app)), app: app}
+
+	tests := []struct {
+		name     string
+		path     string
+		username string
+		password string
+		status   int
+		contains string
+	}{
+		{name: "no credentials", path: "/debug/vars", status: http.StatusUnauthorized},
+		{name: "wrong password", path: "/debug/vars", username: "admin", password: "guess", status: http.StatusUnauthorized},
+		{name: "vars", path: "/debug/vars", username: "admin", password: "s3cret", status: http.StatusOK, contains: `"total_responses_sent_by_status"`},
+		{name: "metrics without credentials", path: "/metrics", status: http.StatusUnauthorized},
+		{name: "metrics", path: "/metrics", username: "admin", password: "s3cret", status: http.StatusOK, contains: "http_requests_total"},
+		{name: "pprof index", path: "/debug/pprof/", username: "admin", password: "s3cret", status: http.StatusOK, contains: "goroutine"},
+		{name: "api routes absent", path: "/v1/healthcheck", username: "admin", password: "s3cret", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.username != "" {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+
+			res := ts.send(t, req)
+			if res.status != tt.status {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+
+			if !strings.Contains(string(res.body), tt.contains) {
+				t.Errorf("body does not contain %q: %s", tt.contains, res.body)
+			}
+		})
+	}
+}
+
+func TestDebugLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "localhost:4001", want: true},
+		{addr: "127.0.0.1:4001", want: true},
+		{addr: "[::1]:4001", want: true},
+		{addr: ":4001", want: false},
+		{addr: "0.0.0.0:4001", want: false},
+		{addr: "[::]:4001", want: false},
+		{addr: "192.168.1.10:4001", want: false},
+		{addr: "debug.example.com:4001", want: false},
+		{addr: "localhost", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := config.LoopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("LoopbackAddr(%q) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var spans bytes.Buffer
+	tracing.SetExporter(tracing.NewWriterExporter(&spans, "greenlight-test"))
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+
+	ts := newTestServer(t)
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/users", strings.NewReader(`{"name":"Alice","email":"alice@example.com","password":"pa55word1234"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", traceparent)
+
+	res := ts.send(t, req)
+	if res.status != http.StatusAccepted {
+		t.Fatalf("got status %d: %s", res.status, res.body)
+	}
+
+	// Closing the server waits for the request span to end, and Wait for the
+	// welcome email to fail against the closed SMTP port.
+	ts.Close()
+	ts.app.Wait()
+
+	names := map[string]bool{}
+
+	for _, line := range strings.Split(strings.TrimSpace(spans.String()), "\n") {
+		var span struct {
+			TraceID string `json:"trace_id"`
+			Name    string `json:"name"`
+			Error   string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(line), &span); err != nil {
+			t.Fatalf("decoding span %q: %v", line, err)
+		}
+
+		if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %q is not part of the incoming trace", span.Name)
+		}
+		names[span.Name] = true
+
+		if span.Name == "Mailer.Send" && span.Error == "" {
+			t.Error("failed email was not recorded on its span")
+		}
+	}
+
+	for _, name := range []string{"POST /v1/users", "bcrypt.GenerateFromPassword", "Application.Background", "Mailer.Send"} {
+		if !names[name] {
+			t.Errorf("missing span %q, got %v", name, names)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		reused bool
+	}{
+		{name: "generated"},
+		{name: "from proxy", header: "edge-7f3a:42", reused: true},
+		{name: "unsafe value replaced", header: "abc\" injected"},
+		{name: "too long replaced", header: strings.Repeat("a", 129)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set("X-Request-ID", tt.header)
+			}
+
+			res := ts.send(t, req)
+
+			id := res.header.Get("X-Request-ID")
+			if id == "" {
+				t.Fatal("no X-Request-ID in the response")
+			}
+			if (id == tt.header) != tt.reused {
+				t.Errorf("got request ID %q for header %q", id, tt.header)
+			}
+
+			if got := res.decode(t)["request_id"]; got != id {
+				t.Errorf("error body has request_id %v, want %q", got, id)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+	id := ts.createMovie(t, token, "Heat", 1995, 170, "crime")
+
+	var logs bytes.Buffer
+	ts.app.Logger.Out = &logs
+	ts.app.Logger.Minlevel = jsonlog.LevelInfo
+
+	res := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", id), nil, token)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d: %s", res.status, res.body)
+	}
+
+	// Closing the server waits for the deferred log line to be written.
+	ts.Close()
+
+	var entry struct {
+		Message    string            `json:"message"`
+		Properties map[string]string `json:"properties"`
+	}
+	err := json.Unmarshal(logs.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", logs.String(), err)
+	}
+
+	want := map[string]string{
+		"request_id": res.header.Get("X-Request-ID"),
+		"method":     http.MethodGet,
+		"route":      "/v1/movies/{id}",
+		"status":     "200",
+		"bytes":      strconv.Itoa(len(res.body)),
+		"remote_ip":  "127.0.0.1",
+		"user_id":    "1",
+	}
+	for key, value := range want {
+		if entry.Properties[key] != value {
+			t.Errorf("got %s %q, want %q", key, entry.Properties[key], value)
+		}
+	}
+
+	if entry.Properties["duration_ms"] == "" {
+		t.Error("missing duration_ms")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	tests := []struct {
+		name           string
+		minSize        int
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{name: "gzip", minSize: 64, acceptEncoding: "gzip, deflate", wantEncoding: "gzip"},
+		{name: "deflate preferred", minSize: 64, acceptEncoding: "gzip;q=0.5, deflate", wantEncoding: "deflate"},
+		{name: "wildcard", minSize: 64, acceptEncoding: "*", wantEncoding: "gzip"},
+		{name: "refused", minSize: 64, acceptEncoding: "gzip;q=0, identity", wantEncoding: ""},
+		{name: "unsupported", minSize: 64, acceptEncoding: "br", wantEncoding: ""},
+		{name: "under threshold", minSize: 1 << 20, acceptEncoding: "gzip", wantEncoding: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, func(appcfg *config.AppConfig) {
+				appcfg.Compression.Enabled = true
+				appcfg.Compression.MinSize = tt.minSize
+			})
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/healthcheck", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Setting the header stops the client from decompressing on its own.
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+			res := ts.send(t, req)
+			if res.status != http.StatusOK {
+				t.Fatalf("got status %d, want %d", res.status, http.StatusOK)
+			}
+
+			if got := res.header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("got Content-Encoding %q, want %q", got, tt.wantEncoding)
+			}
+
+			if !strings.Contains(strings.Join(res.header.Values("Vary"), ","), "Accept-Encoding") {
+				t.Error("Vary does not list Accept-Encoding")
+			}
+
+			var body io.Reader = bytes.NewReader(res.body)
+			switch tt.wantEncoding {
+			case "gzip":
+				body, err = gzip.NewReader(body)
+			case "deflate":
+				body, err = zlib.NewReader(body)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var envelope map[string]interface{}
+			err = json.NewDecoder(body).Decode(&envelope)
+			if err != nil || envelope["status"] != "available" {
+				t.Errorf("body does not decode to the healthcheck: %v", err)
+			}
+		})
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		accept string
+		want   int
+	}{
+		{"", http.StatusOK},
+		{"application/json", http.StatusOK},
+		{"application/*", http.StatusOK},
+		{"text/html, */*;q=0.1", http.StatusOK},
+		{"text/html", http.StatusNotAcceptable},
+		{"application/cbor", http.StatusOK},
+		{"application/json;q=0, text/*", http.StatusNotAcceptable},
+		{"application/xml, text/*", http.StatusNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/healthcheck", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", tt.accept)
+
+		res := ts.send(t, req)
+		if res.status != tt.want {
+			t.Errorf("Accept %q: got status %d, want %d: %s", tt.accept, res.status, tt.want, res.body)
+		}
+	}
+
+	t.Run("other formats", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/export", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "text/csv")
+		req.Header.Set("Authorization", "Bearer "+ts.activatedUserToken(t, "alice@example.com"))
+
+		if res := ts.send(t, req); res.status != http.StatusOK {
+			t.Errorf("export: got status %d, want %d", res.status, http.StatusOK)
+		}
+	})
+}
+
+func TestCompactJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		query  string
+		pretty bool
+	}{
+		{name: "development", mode: "development", pretty: true},
+		{name: "production", mode: "production", pretty: false},
+		{name: "pretty=false", mode: "development", query: "?pretty=false", pretty: false},
+		{name: "pretty=true in production", mode: "production", query: "?pretty=true", pretty: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, func(appcfg *config.AppConfig) {
+				appcfg.Mode = tt.mode
+			})
+
+			res := ts.do(t, http.MethodGet, "/v1/healthcheck"+tt.query, nil, "")
+			if res.status != http.StatusOK {
+				t.Fatalf("got status %d, want %d", res.status, http.StatusOK)
+			}
+
+			if got := bytes.Contains(res.body, []byte("\n\t")); got != tt.pretty {
+				t.Errorf("got indented %t, want %t: %s", got, tt.pretty, res.body)
+			}
+
+			res.decode(t)
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		trusted     []string
+		credentials bool
+		method      string
+		origin      string
+		preflight   bool
+		status      int
+		allowOrigin string
+	}{
+		{name: "no origin", trusted: []string{"https://app.example.com"}, method: http.MethodGet, status: http.StatusOK},
+		{name: "trusted origin", trusted: []string{"https://app.example.com"}, method: http.MethodGet, origin: "https://app.example.com", status: http.StatusOK, allowOrigin: "https://app.example.com"},
+		{name: "untrusted origin", trusted: []string{"https://app.example.com"}, method: http.MethodGet, origin: "https://evil.example.com", status: http.StatusOK},
+		{name: "wildcard", trusted: []string{"*"}, method: http.MethodGet, origin: "https://any.example.com", status: http.StatusOK, allowOrigin: "*"},
+		{name: "wildcard with credentials", trusted: []string{"*"}, credentials: true, method: http.MethodGet, origin: "https://any.example.com", status: http.StatusOK, allowOrigin: "*"},
+		{name: "preflight", trusted: []string{"https://app.example.com"}, method: http.MethodOptions, origin: "https://app.example.com", preflight: true, status: http.StatusOK, allowOrigin: "https://app.example.com"},
+		{name: "untrusted preflight", trusted: []string{"https://app.example.com"}, method: http.MethodOptions, origin: "https://evil.example.com", preflight: true, status: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, func(appcfg *config.AppConfig) {
+				appcfg.CORS.TrustedOrigins = tt.trusted
+				appcfg.CORS.AllowCredentials = tt.credentials
+				appcfg.CORS.MaxAge = time.Minute
+			})
+
+			req, err := http.NewRequest(tt.method, ts.URL+"/v1/healthcheck", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			}
+
+			res := ts.send(t, req)
+			if res.status != tt.status {
+				t.Errorf("got status %d, want %d", res.status, tt.status)
+			}
+
+			if got := res.header.Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.allowOrigin)
+			}
+
+			if !strings.Contains(strings.Join(res.header.Values("Vary"), ","), "Origin") {
+				t.Errorf("missing Vary: Origin, got %v", res.header.Values("Vary"))
+			}
+
+			if got := res.header.Get("Access-Control-Allow-Credentials"); (got == "true") != (tt.credentials && tt.allowOrigin != "" && tt.allowOrigin != "*") {
+				t.Errorf("got Access-Control-Allow-Credentials %q", got)
+			}
+
+			if tt.preflight && tt.allowOrigin != "" {
+				if !strings.Contains(res.header.Get("Access-Control-Allow-Methods"), http.MethodPut) {
+					t.Errorf("got Access-Control-Allow-Methods %q", res.header.Get("Access-Control-Allow-Methods"))
+				}
+				if got := res.header.Get("Access-Control-Max-Age"); got != "60" {
+					t.Errorf("got Access-Control-Max-Age %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestRouting(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"unknown route", http.MethodGet, "/v1/nothing-here", http.StatusNotFound},
+		{"method not allowed", http.MethodPut, "/v1/healthcheck", http.StatusMethodNotAllowed},
+		{"movies need authentication", http.MethodGet, "/v1/movies", http.StatusUnauthorized},
+		{"export needs authentication", http.MethodGet, "/v1/movies/export", http.StatusUnauthorized},
+		{"search needs authentication", http.MethodGet, "/v1/movies/search?q=heat", http.StatusUnauthorized},
+		{"autocomplete needs authentication", http.MethodGet, "/v1/movies/autocomplete?q=heat", http.StatusUnauthorized},
+		{"creating needs authentication", http.MethodPost, "/v1/movies", http.StatusUnauthorized},
+		{"updating needs authentication", http.MethodPatch, "/v1/movies/1", http.StatusUnauthorized},
+		{"deleting needs authentication", http.MethodDelete, "/v1/movies/1", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, tt.method, tt.path, nil, "")
+			if res.status != tt.status {
+				t.Errorf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+
+			if _, found := res.decode(t)["error"]; !found {
+				t.Errorf("response has no error envelope: %s", res.body)
+			}
+		})
+	}
+}
+
+func TestUserRegistration(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.registerUser(t, "Alice", "alice@example.com", "pa55word1234")
+
+	tests := []struct {
+		name      string
+		body      interface{}
+		status    int
+		errorKeys []string
+	}{
+		{"duplicate email", map[string]string{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"}, http.StatusUnprocessableEntity, []string{"email"}},
+		{"duplicate email in another case", map[string]string{"name": "Alice", "email": "ALICE@example.com", "password": "pa55word1234"}, http.StatusUnprocessableEntity, []string{"email"}},
+		{"invalid email", map[string]string{"name": "Bob", "email": "not-an-email", "password": "pa55word1234"}, http.StatusUnprocessableEntity, []string{"email"}},
+		{"short password", map[string]string{"name": "Bob", "email": "bob@example.com", "password": "short"}, http.StatusUnprocessableEntity, []string{"password"}},
+		{"missing name", map[string]string{"email": "bob@example.com", "password": "pa55word1234"}, http.StatusUnprocessableEntity, []string{"username"}},
+		{"malformed JSON", `{"name": "Bob",`, http.StatusBadRequest, nil},
+		{"unknown field", `{"name": "Bob", "email": "bob@example.com", "password": "pa55word1234", "admin": true}`, http.StatusBadRequest, nil},
+		{"empty body", "", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/users", tt.body, "")
+			if res.status != tt.status {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+
+			for _, key := range tt.errorKeys {
+				errs, _ := res.decode(t)["error"].(map[string]interface{})
+				if _, found := errs[key]; !found {
+					t.Errorf("missing validation error for %q: %s", key, res.body)
+				}
+			}
+		})
+	}
+}
+
+func TestUserActivation(t *testing.T) {
+	ts := newTestServer(t)
+
+	id := ts.registerUser(t, "Alice", "alice@example.com", "pa55word1234")
+	token := ts.tokens.latest(id, data.ScopeActivation)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"malformed token", "too-short", http.StatusUnprocessableEntity},
+		{"unknown token", strings.Repeat("A", 26), http.StatusUnprocessableEntity},
+		{"valid token", token, http.StatusOK},
+		{"token already used", token, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPut, "/v1/users/activated", map[string]string{"token": tt.token}, "")
+			if res.status != tt.status {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+
+			if tt.status == http.StatusOK {
+				user := res.decode(t)["user"].(map[string]interface{})
+				if user["activated"] != true {
+					t.Errorf("user was not activated: %s", res.body)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.activatedUserToken(t, "alice@example.com")
+	ts.registerUser(t, "Bob", "bob@example.com", "pa55word1234")
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+	}{
+		{"valid credentials", map[string]string{"email": "alice@example.com", "password": "pa55word1234"}, http.StatusCreated},
+		{"wrong password", map[string]string{"email": "alice@example.com", "password": "wrong-password"}, http.StatusUnauthorized},
+		{"unknown email", map[string]string{"email": "carol@example.com", "password": "pa55word1234"}, http.StatusUnauthorized},
+		{"invalid email", map[string]string{"email": "carol", "password": "pa55word1234"}, http.StatusUnprocessableEntity},
+		{"missing password", map[string]string{"email": "alice@example.com"}, http.StatusUnprocessableEntity},
+		{"malformed JSON", `{"email":`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/users/authentication", tt.body, "")
+			if res.status != tt.status {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+		})
+	}
+
+	t.Run("inactive account", func(t *testing.T) {
+		token := ts.login(t, "bob@example.com", "pa55word1234")
+
+		res := ts.do(t, http.MethodGet, "/v1/movies", nil, token)
+		if res.status != http.StatusForbidden {
+			t.Errorf("got status %d, want %d: %s", res.status, http.StatusForbidden, res.body)
+		}
+	})
+
+	t.Run("invalid bearer token", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/movies", nil, strings.Repeat("B", 26))
+		if res.status != http.StatusUnauthorized {
+			t.Errorf("got status %d, want %d: %s", res.status, http.StatusUnauthorized, res.body)
+		}
+
+		if got := res.header.Get("WWW-Authenticate"); got != "Bearer" {
+			t.Errorf("got WWW-Authenticate %q, want %q", got, "Bearer")
+		}
+	})
+}
+
+func TestMovieCRUD(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+
+	id := ts.createMovie(t, token, "Moana", 2016, 107, "animation", "adventure")
+	path := fmt.Sprintf("/v1/movies/%d", id)
+
+	t.Run("show", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, path, nil, token)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		movie := res.decode(t)["movie"].(map[string]interface{})
+		if movie["title"] != "Moana" || movie["runtime"] != "107 mins" || movie["version"] != float64(1) {
+			t.Errorf("unexpected movie: %s", res.body)
+		}
+	})
+
+	t.Run("show sparse fields", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, path+"?fields=id,title", nil, token)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		movie := res.decode(t)["movie"].(map[string]interface{})
+		if len(movie) != 2 || movie["title"] != "Moana" {
+			t.Errorf("unexpected movie: %s", res.body)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		res := ts.do(t, http.MethodPatch, path, map[string]interface{}{"year": 2015, "genres": []string{"animation"}}, token)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		movie := res.decode(t)["movie"].(map[string]interface{})
+		if movie["year"] != float64(2015) || movie["title"] != "Moana" || movie["version"] != float64(2) {
+			t.Errorf("unexpected movie: %s", res.body)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		res := ts.do(t, http.MethodDelete, path, nil, token)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		for _, method := range []string{http.MethodGet, http.MethodDelete, http.MethodPatch} {
+			res = ts.do(t, method, path, map[string]interface{}{"year": 2015}, token)
+			if res.status != http.StatusNotFound {
+				t.Errorf("%s after delete: got status %d, want %d: %s", method, res.status, http.StatusNotFound, res.body)
+			}
+		}
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/movies/abc", nil, token)
+		if res.status != http.StatusNotFound {
+			t.Errorf("got status %d, want %d: %s", res.status, http.StatusNotFound, res.body)
+		}
+	})
+}
+
+// doEncoded sends body, already encoded as contentType, asking for accept.
+func (ts *testServer) doEncoded(t *testing.T, method, path string, body []byte, contentType, accept, token string) testResponse {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return ts.send(t, req)
+}
+
+func TestBinaryEncodings(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+
+	for _, c := range []*codec.Codec{codec.MessagePack, codec.CBOR} {
+		t.Run(c.Name, func(t *testing.T) {
+			encode := func(js string) []byte {
+				b, err := c.FromJSON([]byte(js))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			}
+
+			decode := func(res testResponse) map[string]interface{} {
+				t.Helper()
+
+				if got := res.header.Get("Content-Type"); got != c.MediaType {
+					t.Fatalf("got Content-Type %q, want %q: %s", got, c.MediaType, res.body)
+				}
+
+				js, err := c.ToJSON(res.body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return testResponse{body: js}.decode(t)
+			}
+
+			res := ts.doEncoded(t, http.MethodPost, "/v1/movies", encode(`{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"]}`), c.MediaType, c.MediaType, token)
+			if res.status != http.StatusOK {
+				t.Fatalf("create: got status %d, want %d", res.status, http.StatusOK)
+			}
+
+			movie := decode(res)["movie"].(map[string]interface{})
+			if movie["title"] != "Moana" || movie["runtime"] != "107 mins" {
+				t.Errorf("unexpected movie: %v", movie)
+			}
+
+			res = ts.doEncoded(t, http.MethodGet, fmt.Sprintf("/v1/movies/%v", movie["id"]), nil, "", c.MediaType, token)
+			if got := decode(res)["movie"].(map[string]interface{})["year"]; got != float64(2016) {
+				t.Errorf("show: got year %v, want 2016", got)
+			}
+
+			tests := []struct {
+				name  string
+				body  []byte
+				error string
+			}{
+				{"malformed", []byte{0xc1}, "body contains badly-formed " + c.Name},
+				{"truncated", encode(`{"title":"Moana"}`)[:4], "body contains badly-formed " + c.Name},
+				{"empty", nil, "body must not be empty"},
+				{"trailing", append(encode(`{}`), encode(`{}`)...), "body must only contain a single " + c.Name + " value"},
+				{"unknown field", encode(`{"budget":1}`), `body contains unknown field`},
+				{"wrong type", encode(`{"title":1}`), `body contains incorrect ` + c.Name + ` type for field "title"`},
+				{"runtime", encode(`{"title":"Moana","year":2016,"runtime":107,"genres":["animation"]}`), "invalid runtime format"},
+			}
+
+			for _, tt := range tests {
+				res := ts.doEncoded(t, http.MethodPost, "/v1/movies", tt.body, c.MediaType, c.MediaType, token)
+				if res.status != http.StatusBadRequest {
+					t.Errorf("%s: got status %d, want %d", tt.name, res.status, http.StatusBadRequest)
+					continue
+				}
+
+				if got, _ := decode(res)["error"].(string); !strings.HasPrefix(got, tt.error) {
+					t.Errorf("%s: got error %q, want it to start with %q", tt.name, got, tt.error)
+				}
+			}
+		})
+	}
+}
+
+func TestMovieValidation(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+
+	id := ts.createMovie(t, token, "Heat", 1995, 170, "crime")
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      interface{}
+		status    int
+		errorKeys []string
+	}{
+		{"missing everything", http.MethodPost, "/v1/movies", map[string]interface{}{}, http.StatusUnprocessableEntity, []string{"title", "year", "runtime", "genres"}},
+		{"duplicate genres", http.MethodPost, "/v1/movies", map[string]interface{}{"title": "Heat", "year": 1995, "runtime": "170 mins", "genres": []string{"crime", "crime"}}, http.StatusUnprocessableEntity, []string{"genres"}},
+		{"too many genres", http.MethodPost, "/v1/movies", map[string]interface{}{"title": "Heat", "year": 1995, "runtime": "170 mins", "genres": []string{"a", "b", "c", "d", "e", "f"}}, http.StatusUnprocessableEntity, []string{"genres"}},
+		{"bad runtime format", http.MethodPost, "/v1/movies", map[string]interface{}{"title": "Heat", "year": 1995, "runtime": 170, "genres": []string{"crime"}}, http.StatusBadRequest, nil},
+		{"future year on update", http.MethodPatch, fmt.Sprintf("/v1/movies/%d", id), map[string]interface{}{"year": 3000}, http.StatusUnprocessableEntity, []string{"creation_date"}},
+		{"unknown list field", http.MethodGet, "/v1/movies?fields=id,budget", nil, http.StatusUnprocessableEntity, []string{"fields"}},
+		{"bad page size", http.MethodGet, "/v1/movies?page_size=1000", nil, http.StatusUnprocessableEntity, []string{"page_size"}},
+		{"page size limit", http.MethodGet, "/v1/movies?page_size=100", nil, http.StatusUnprocessableEntity, []string{"page_size"}},
+		{"title limit", http.MethodPost, "/v1/movies", map[string]interface{}{"title": strings.Repeat("x", 500), "year": 1995, "runtime": "170 mins", "genres": []string{"crime"}}, http.StatusUnprocessableEntity, []string{"title"}},
+		{"missing year", http.MethodPost, "/v1/movies", map[string]interface{}{"title": "Heat", "runtime": "170 mins", "genres": []string{"crime"}}, http.StatusUnprocessableEntity, []string{"year", "creation_date"}},
+		{"duplicate sort", http.MethodGet, "/v1/movies?sort=year,-year", nil, http.StatusUnprocessableEntity, []string{"sort"}},
+		{"unknown sort", http.MethodGet, "/v1/movies?sort=budget", nil, http.StatusUnprocessableEntity, []string{"sort"}},
+		{"inverted year range", http.MethodGet, "/v1/movies?year_min=2000&year_max=1990", nil, http.StatusUnprocessableEntity, []string{"year_min"}},
+		{"tampered cursor", http.MethodGet, "/v1/movies?cursor=abc.def", nil, http.StatusUnprocessableEntity, []string{"cursor"}},
+		{"bad export format", http.MethodGet, "/v1/movies/export?format=xml", nil, http.StatusUnprocessableEntity, []string{"format"}},
+		{"empty search", http.MethodGet, "/v1/movies/search", nil, http.StatusUnprocessableEntity, []string{"q"}},
+		{"autocomplete limit", http.MethodGet, "/v1/movies/autocomplete?q=he&limit=0", nil, http.StatusUnprocessableEntity, []string{"limit"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, tt.method, tt.path, tt.body, token)
+			if res.status != tt.status {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+
+			errs, _ := res.decode(t)["error"].(map[string]interface{})
+			for _, key := range tt.errorKeys {
+				if _, found := errs[key]; !found {
+					t.Errorf("missing validation error for %q: %s", key, res.body)
+				}
+			}
+		})
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+
+	send := func(t *testing.T, method, path string, body []byte, accept string) testResponse {
+		t.Helper()
+
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", accept)
+
+		return ts.send(t, req)
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		res := send(t, http.MethodPost, "/v1/movies", []byte(`{}`), "application/json, application/problem+json")
+		if res.status != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusUnprocessableEntity, res.body)
+		}
+		if got := res.header.Get("Content-Type"); got != "application/problem+json" {
+			t.Errorf("got Content-Type %q, want application/problem+json", got)
+		}
+
+		var problem config.Problem
+		if err := json.Unmarshal(res.body, &problem); err != nil {
+			t.Fatalf("decoding %s: %v", res.body, err)
+		}
+
+		if problem.Type != "about:blank" || problem.Title != "Unprocessable Entity" || problem.Status != http.StatusUnprocessableEntity || problem.Instance != "/v1/movies" {
+			t.Errorf("got problem %+v", problem)
+		}
+		if problem.RequestID == "" || problem.RequestID != res.header.Get("X-Request-ID") {
+			t.Errorf("got request_id %q, want %q", problem.RequestID, res.header.Get("X-Request-ID"))
+		}
+
+		var fields []string
+		for _, e := range problem.Errors {
+			if e.Message == "" || e.Code == "" {
+				t.Errorf("incomplete error %+v", e)
+			}
+			fields = append(fields, e.Field)
+		}
+		if got, want := strings.Join(fields, ","), "creation_date,genres,runtime,title,year"; got != want {
+			t.Errorf("got error fields %s, want %s", got, want)
+		}
+	})
+
+	t.Run("detail", func(t *testing.T) {
+		res := send(t, http.MethodGet, "/v1/movies/999", nil, "application/problem+json, application/json;q=0.9")
+		if res.status != http.StatusNotFound {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusNotFound, res.body)
+		}
+
+		body := res.decode(t)
+		if body["detail"] != "the resource could not be found." || body["title"] != "Not Found" {
+			t.Errorf("got %s", res.body)
+		}
+		if _, found := body["errors"]; found {
+			t.Errorf("unexpected errors member: %s", res.body)
+		}
+	})
+
+	t.Run("problem type alone", func(t *testing.T) {
+		res := send(t, http.MethodGet, "/v1/healthcheck", nil, "application/problem+json")
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+		if got := res.header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("got Content-Type %q, want application/json", got)
+		}
+
+		res = send(t, http.MethodGet, "/v1/movies/999", nil, "application/problem+json")
+		if res.status != http.StatusNotFound {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusNotFound, res.body)
+		}
+		if got := res.header.Get("Content-Type"); got != "application/problem+json" {
+			t.Errorf("got Content-Type %q, want application/problem+json", got)
+		}
+	})
+
+	t.Run("envelope by default", func(t *testing.T) {
+		for _, accept := range []string{"", "application/json", "*/*", "application/problem+json;q=0, application/json"} {
+			res := send(t, http.MethodPost, "/v1/movies", []byte(`{}`), accept)
+			if got := res.header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Accept %q: got Content-Type %q, want application/json", accept, got)
+			}
+			if _, found := res.decode(t)["error"].(map[string]interface{}); !found {
+				t.Errorf("Accept %q: missing error envelope: %s", accept, res.body)
+			}
+		}
+	})
+}
+
+func TestValidationMessages(t *testing.T) {
+	ts := newTestServer(t)
+
+	register := func(t *testing.T, accept, language string) testResponse {
+		t.Helper()
+
+		body := []byte(`{"name": "Bob", "email": "bob.example.com", "password": "pa55"}`)
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/users", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Accept-Language", language)
+
+		res := ts.send(t, req)
+		if res.status != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusUnprocessableEntity, res.body)
+		}
+		return res
+	}
+
+	tests := []struct {
+		language string
+		locale   string
+		email    string
+		password string
+	}{
+		{"", "en", "must be a valid email address", "must be at least 8 bytes long"},
+		{"fr, en;q=0.5", "en", "must be a valid email address", "must be at least 8 bytes long"},
+		{"es", "es", "debe ser una dirección de correo electrónico válida", "debe tener al menos 8 bytes"},
+		{"es-MX, en;q=0.8", "es", "debe ser una dirección de correo electrónico válida", "debe tener al menos 8 bytes"},
+		{"en-GB, es;q=0.9", "en", "must be a valid email address", "must be at least 8 bytes long"},
+	}
+
+	for _, tt := range tests {
+		t.Run("Accept-Language "+tt.language, func(t *testing.T) {
+			res := register(t, "application/json", tt.language)
+
+			if got := res.header.Get("Content-Language"); got != tt.locale {
+				t.Errorf("got Content-Language %q, want %q", got, tt.locale)
+			}
+
+			errs, _ := res.decode(t)["error"].(map[string]interface{})
+			if errs["email"] != tt.email || errs["password"] != tt.password {
+				t.Errorf("got errors %v", errs)
+			}
+		})
+	}
+
+	t.Run("codes", func(t *testing.T) {
+		res := register(t, "application/json, application/problem+json", "es")
+
+		var problem config.Problem
+		if err := json.Unmarshal(res.body, &problem); err != nil {
+			t.Fatalf("decoding %s: %v", res.body, err)
+		}
+
+		var codes []string
+		for _, e := range problem.Errors {
+			codes = append(codes, e.Field+":"+e.Code)
+
+			if e.Code == "too_short" && e.Params["min"] != float64(8) {
+				t.Errorf("got params %v, want min 8", e.Params)
+			}
+		}
+		if got, want := strings.Join(codes, ","), "email:invalid_email,password:too_short"; got != want {
+			t.Errorf("got codes %s, want %s", got, want)
+		}
+	})
+
+	t.Run("every failure of a field", func(t *testing.T) {
+		token := ts.activatedUserToken(t, "alice@example.com")
+
+		res := ts.do(t, http.MethodGet, "/v1/movies?fields=id,budget,id,gross", nil, token)
+		if res.status != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusUnprocessableEntity, res.body)
+		}
+
+		errs, _ := res.decode(t)["error"].(map[string]interface{})
+		message, _ := errs["fields"].(string)
+		for _, want := range []string{`"budget" is not supported`, `"gross" is not supported`, "must not contain duplicate values"} {
+			if !strings.Contains(message, want) {
+				t.Errorf("fields error %q does not mention %q", message, want)
+			}
+		}
+	})
+}
+
+// conflictingMovies sneaks a competing update in between the handler reading a
+// movie and writing it back, which is exactly the race optimistic locking
+// guards against.
+type conflictingMovies struct {
+	data.MovieRepository
+}
+
+func (cm conflictingMovies) Get(ctx context.Context, id int64, fields []string) (*data.Movie, error) {
+	movie, err := cm.MovieRepository.Get(ctx, id, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	competing := *movie
+	err = cm.MovieRepository.Update(ctx, &competing)
+	if err != nil {
+		return nil, err
+	}
+
+	return movie, nil
+}
+
+func TestMovieEditConflict(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+
+	id := ts.createMovie(t, token, "Heat", 1995, 170, "crime")
+
+	ts.app.Models.Movies = conflictingMovies{MovieRepository: ts.app.Models.Movies}
+
+	res := ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/movies/%d", id), map[string]interface{}{"runtime": "171 mins"}, token)
+	if res.status != http.StatusConflict {
+		t.Errorf("got status %d, want %d: %s", res.status, http.StatusConflict, res.body)
+	}
+}
+
+// failingMovies makes every lookup fail with err, the way the Postgres models
+// do when the query context ends.
+type failingMovies struct {
+	data.MovieRepository
+	err error
+}
+
+func (fm failingMovies) Get(ctx context.Context, id int64, fields []string) (*data.Movie, error) {
+	return nil, fm.err
+}
+
+// doIdempotent is do with an Idempotency-Key header.
+func (ts *testServer) doIdempotent(t *testing.T, method, path, key string, body interface{}, token string) testResponse {
+	t.Helper()
+
+	js, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", key)
+
+	return ts.send(t, req)
+}
+
+func TestIdempotency(t *testing.T) {
+	app, tokens := newTestApplication(t)
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		calls   atomic.Int32
+	)
+
+	routes := getRoutes(app)
+	routes.Post("/v1/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})
+	routes.Post("/v1/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			app.InternalSErrorResponse(w, r, errors.New("temporary failure"))
+			return
+		}
+		app.JsonWriter(w, r, http.StatusOK, config.Envelope{"call": calls.Load()}, nil)
+	})
+
+	ts := &testServer{Server: newHTTPTestServer(t, routes), app: app, tokens: tokens}
+
+	alice := ts.activatedUserToken(t, "alice@example.com")
+	bob := ts.activatedUserToken(t, "bob@example.com")
+
+	movie := map[string]interface{}{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+	t.Run("replay", func(t *testing.T) {
+		first := ts.doIdempotent(t, http.MethodPost, "/v1/movies", "create-moana", movie, alice)
+		if first.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", first.status, http.StatusOK, first.body)
+		}
+
+		retry := ts.doIdempotent(t, http.MethodPost, "/v1/movies", "create-moana", movie, alice)
+		if retry.status != first.status || !bytes.Equal(retry.body, first.body) {
+			t.Errorf("retry got %d %s, want %d %s", retry.status, retry.body, first.status, first.body)
+		}
+		if retry.header.Get("Idempotent-Replayed") != "true" || first.header.Get("Idempotent-Replayed") != "" {
+			t.Error("Idempotent-Replayed is not set on the replay only")
+		}
+		if got := retry.header.Get("Content-Type"); got != first.header.Get("Content-Type") {
+			t.Errorf("replay got Content-Type %q, want %q", got, first.header.Get("Content-Type"))
+		}
+
+		res := ts.do(t, http.MethodGet, "/v1/movies", nil, alice)
+		if got := len(res.decode(t)["movies"].([]interface{})); got != 1 {
+			t.Errorf("got %d movies, want 1", got)
+		}
+	})
+
+	t.Run("different body", func(t *testing.T) {
+		other := map[string]interface{}{"title": "Coco", "year": 2017, "runtime": "105 mins", "genres": []string{"animation"}}
+
+		res := ts.doIdempotent(t, http.MethodPost, "/v1/movies", "create-moana", other, alice)
+		if res.status != http.StatusUnprocessableEntity {
+			t.Errorf("got status %d, want %d: %s", res.status, http.StatusUnprocessableEntity, res.body)
+		}
+	})
+
+	t.Run("different negotiation", func(t *testing.T) {
+		js, err := json.Marshal(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The stored response is JSON in English, which is not what these
+		// retries asked for.
+		for name, value := range map[string]string{"Accept": "application/cbor", "Accept-Language": "es"} {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/movies", bytes.NewReader(js))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+alice)
+			req.Header.Set("Idempotency-Key", "create-moana")
+			req.Header.Set(name, value)
+
+			if res := ts.send(t, req); res.status != http.StatusUnprocessableEntity {
+				t.Errorf("%s %s: got status %d, want %d", name, value, res.status, http.StatusUnprocessableEntity)
+			}
+		}
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		res := ts.doIdempotent(t, http.MethodPost, "/v1/movies", "create-moana", movie, bob)
+		if res.status != http.StatusOK || res.header.Get("Idempotent-Replayed") != "" {
+			t.Errorf("got status %d replayed %q, want a fresh %d", res.status, res.header.Get("Idempotent-Replayed"), http.StatusOK)
+		}
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		res := ts.doIdempotent(t, http.MethodPost, "/v1/movies", "not a key", movie, alice)
+		if res.status != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d: %s", res.status, http.StatusBadRequest, res.body)
+		}
+	})
+
+	t.Run("in flight", func(t *testing.T) {
+		done := make(chan testResponse)
+		go func() {
+			done <- ts.doIdempotent(t, http.MethodPost, "/v1/slow", "slow", nil, alice)
+		}()
+
+		<-started
+
+		res := ts.doIdempotent(t, http.MethodPost, "/v1/slow", "slow", nil, alice)
+		if res.status != http.StatusConflict {
+			t.Errorf("got status %d, want %d: %s", res.status, http.StatusConflict, res.body)
+		}
+
+		close(release)
+
+		if first := <-done; first.status != http.StatusAccepted {
+			t.Errorf("first request got status %d, want %d", first.status, http.StatusAccepted)
+		}
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		res := ts.doIdempotent(t, http.MethodPost, "/v1/flaky", "flaky", nil, alice)
+		if res.status != http.StatusInternalServerError {
+			t.Fatalf("got status %d, want %d", res.status, http.StatusInternalServerError)
+		}
+
+		res = ts.doIdempotent(t, http.MethodPost, "/v1/flaky", "flaky", nil, alice)
+		if res.status != http.StatusOK || res.header.Get("Idempotent-Replayed") != "" {
+			t.Errorf("retry got status %d replayed %q, want the handler to run again", res.status, res.header.Get("Idempotent-Replayed"))
+		}
+	})
+}
+
+func TestMovieQueryCancellation(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+
+	id := ts.createMovie(t, token, "Heat", 1995, 170, "crime")
+	movies := ts.app.Models.Movies
+
+	// cause, when set, cancels the request context the way net/http does for
+	// a client that went away (context.Canceled) or serve does at shutdown.
+	tests := []struct {
+		name   string
+		err    error
+		cause  error
+		status int
+	}{
+		{"client gone", context.Canceled, context.Canceled, config.StatusClientClosedRequest},
+		{"shutdown", context.Canceled, config.ErrShuttingDown, http.StatusServiceUnavailable},
+		{"failure after the client left", errors.New("connection refused"), context.Canceled, http.StatusInternalServerError},
+		{"cancelled elsewhere", context.Canceled, nil, http.StatusInternalServerError},
+		{"deadline", fmt.Errorf("querying: %w", context.DeadlineExceeded), nil, http.StatusServiceUnavailable},
+		{"other", errors.New("connection refused"), nil, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts.app.Models.Movies = failingMovies{MovieRepository: movies, err: tt.err}
+
+			srv := ts
+			if tt.cause != nil {
+				routes := ts.Config.Handler
+				srv = &testServer{Server: newHTTPTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ctx, cancel := context.WithCancelCause(r.Context())
+					cancel(tt.cause)
+					routes.ServeHTTP(w, r.WithContext(ctx))
+				})), app: ts.app}
+			}
+
+			res := srv.do(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", id), nil, token)
+			if res.status != tt.status {
+				t.Errorf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+		})
+	}
+}
+
+func TestMovieListing(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+
+	ts.createMovie(t, token, "The Godfather", 1972, 175, "crime", "drama")
+	ts.createMovie(t, token, "The Godfather Part II", 1974, 202, "crime", "drama")
+	ts.createMovie(t, token, "Heat", 1995, 170, "crime", "action")
+	ts.createMovie(t, token, "Moana", 2016, 107, "animation", "adventure")
+	ts.createMovie(t, token, "Up", 2009, 96, "animation", "adventure", "comedy")
+
+	titles := func(t *testing.T, res testResponse) []string {
+		t.Helper()
+
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		list := []string{}
+		for _, movie := range res.decode(t)["movies"].([]interface{}) {
+			list = append(list, movie.(map[string]interface{})["title"].(string))
+		}
+		return list
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"title search", "?title=godfather", []string{"The Godfather", "The Godfather Part II"}},
+		{"all genres", "?genres=animation,comedy", []string{"Up"}},
+		{"any genre", "?genres_any=action,comedy&sort=title", []string{"Heat", "Up"}},
+		{"excluded genre", "?genres_exclude=crime&sort=-year", []string{"Moana", "Up"}},
+		{"year range", "?year_min=1973&year_max=2010&sort=year", []string{"The Godfather Part II", "Heat", "Up"}},
+		{"runtime range", "?runtime_max=110&sort=runtime", []string{"Up", "Moana"}},
+		{"multi-column sort", "?sort=-runtime,title&genres=crime", []string{"The Godfather Part II", "The Godfather", "Heat"}},
+		{"fuzzy title", "?title=godfater&fuzzy=true&sort=year", []string{"The Godfather", "The Godfather Part II"}},
+		{"no fuzzy fallback", "?title=godfater", []string{}},
+		{"fuzzy title next page", "?title=godfater&fuzzy=true&sort=year&page_size=1&page=2", []string{"The Godfather Part II"}},
+		{"past the exact matches", "?title=godfather+part&fuzzy=true&sort=year&page_size=1&page=2", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := titles(t, ts.do(t, http.MethodGet, "/v1/movies"+tt.query, nil, token))
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("cursor pagination", func(t *testing.T) {
+		var seen []string
+
+		path := "/v1/movies?sort=-year&page_size=2"
+		for page := 0; page < 5; page++ {
+			res := ts.do(t, http.MethodGet, path, nil, token)
+			seen = append(seen, titles(t, res)...)
+
+			next, _ := res.decode(t)["metadata"].(map[string]interface{})["next_cursor"].(string)
+			if next == "" {
+				break
+			}
+			path = "/v1/movies?sort=-year&page_size=2&cursor=" + next
+		}
+
+		want := []string{"Moana", "Up", "Heat", "The Godfather Part II", "The Godfather"}
+		if strings.Join(seen, "|") != strings.Join(want, "|") {
+			t.Errorf("got %q, want %q", seen, want)
+		}
+	})
+}
+
+func TestMovieSearchAndExport(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.activatedUserToken(t, "alice@example.com")
+
+	ts.createMovie(t, token, "The Godfather", 1972, 175, "crime", "drama")
+	ts.createMovie(t, token, "Heat", 1995, 170, "crime", "action")
+
+	t.Run("search", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/movies/search?q=godfather", nil, token)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		results := res.decode(t)["results"].([]interface{})
+		if len(results) != 1 || !strings.Contains(results[0].(map[string]interface{})["headline"].(string), "<mark>") {
+			t.Errorf("unexpected results: %s", res.body)
+		}
+	})
+
+	t.Run("search escapes markup", func(t *testing.T) {
+		id := ts.createMovie(t, token, `Heist <img src=x onerror=alert(1)> & Day`, 2001, 109, "crime")
+		defer ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/movies/%d", id), nil, token)
+
+		res := ts.do(t, http.MethodGet, "/v1/movies/search?q=heist", nil, token)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		results := res.decode(t)["results"].([]interface{})
+		if len(results) != 1 {
+			t.Fatalf("unexpected results: %s", res.body)
+		}
+
+		headline := results[0].(map[string]interface{})["headline"].(string)
+		if !strings.Contains(headline, "<mark>Heist</mark>") || !strings.Contains(headline, "&lt;img src=x onerror=alert(1)&gt; &amp; Day") || strings.Contains(headline, "<img") {
+			t.Errorf("markup in the title not escaped: %s", headline)
+		}
+	})
+
+	t.Run("autocomplete", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/movies/autocomplete?q=godf", nil, token)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		suggestions := res.decode(t)["suggestions"].([]interface{})
+		if len(suggestions) == 0 || suggestions[0].(map[string]interface{})["title"] != "The Godfather" {
+			t.Errorf("unexpected suggestions: %s", res.body)
+		}
+	})
+
+	tests := []struct {
+		name        string
+		query       string
+		accept      string
+		contentType string
+		lines       int
+	}{
+		{"csv by parameter", "?format=csv", "", "text/csv; charset=utf-8", 3},
+		{"ndjson by accept", "", "application/x-ndjson", "application/x-ndjson", 2},
+		{"json by default", "?genres=action", "", "application/json", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run("export "+tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/export"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			res := ts.send(t, req)
+			if res.status != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+			}
+
+			if got := res.header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got content type %q, want %q", got, tt.contentType)
+			}
+
+			if got := strings.Count(string(res.body), "\n"); got != tt.lines {
+				t.Errorf("got %d lines, want %d: %s", got, tt.lines, res.body)
+			}
+		})
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	ts := newTestServer(t, func(appcfg *config.AppConfig) {
+		appcfg.Limiter.Enabled = true
+		appcfg.Limiter.Rps = 0.1
+		appcfg.Limiter.Burst = 2
+	})
+
+	tests := []struct {
+		status     int
+		remaining  string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", ""},
+		{http.StatusOK, "0", ""},
+		{http.StatusTooManyRequests, "0", "10"},
+	}
+
+	for i, tt := range tests {
+		res := ts.do(t, http.MethodGet, "/v1/healthcheck", nil, "")
+		if res.status != tt.status {
+			t.Errorf("request %d: got status %d, want %d", i+1, res.status, tt.status)
+		}
+
+		if got := res.header.Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: got RateLimit-Limit %q, want %q", i+1, got, "2")
+		}
+		if got := res.header.Get("RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: got RateLimit-Remaining %q, want %q", i+1, got, tt.remaining)
+		}
+		if got := res.header.Get("RateLimit-Reset"); got == "" || got == "0" {
+			t.Errorf("request %d: got RateLimit-Reset %q, want the seconds until the bucket refills", i+1, got)
+		}
+		if got := res.header.Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("request %d: got Retry-After %q, want %q", i+1, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestRateLimitingPerUser(t *testing.T) {
+	ts := newTestServer(t, func(appcfg *config.AppConfig) {
+		appcfg.Limiter.Rps = 0.1
+		appcfg.Limiter.Burst = 10
+		appcfg.Limiter.UserRps = 0.1
+		appcfg.Limiter.UserBurst = 3
+	})
+
+	alice := ts.activatedUserToken(t, "alice@example.com")
+	bob := ts.activatedUserToken(t, "bob@example.com")
+
+	ts.app.Config.Limiter.Enabled = true
+
+	// Both users share the test client's IP, whose bucket has room for all of
+	// their requests, but each runs out of a user bucket of its own first.
+	for _, token := range []string{alice, bob} {
+		for i := 0; i < 3; i++ {
+			res := ts.do(t, http.MethodGet, "/v1/movies", nil, token)
+			if res.status != http.StatusOK {
+				t.Fatalf("request %d: got status %d, want %d: %s", i+1, res.status, http.StatusOK, res.body)
+			}
+			if got := res.header.Get("RateLimit-Limit"); got != "3" {
+				t.Errorf("got RateLimit-Limit %q, want %q", got, "3")
+			}
+		}
+
+		res := ts.do(t, http.MethodGet, "/v1/movies", nil, token)
+		if res.status != http.StatusTooManyRequests {
+			t.Errorf("got status %d, want %d", res.status, http.StatusTooManyRequests)
+		}
+	}
+
+	res := ts.do(t, http.MethodGet, "/v1/healthcheck", nil, "")
+	if res.status != http.StatusOK {
+		t.Errorf("anonymous request: got status %d, want %d", res.status, http.StatusOK)
+	}
+}
+
+func TestRateLimitingInvalidTokens(t *testing.T) {
+	ts := newTestServer(t, func(appcfg *config.AppConfig) {
+		appcfg.Limiter.Enabled = true
+		appcfg.Limiter.Rps = 0.1
+		appcfg.Limiter.Burst = 2
+		appcfg.Limiter.UserRps = 100
+		appcfg.Limiter.UserBurst = 100
+	})
+
+	// Malformed and unknown tokens are answered by Authenticate, which must not
+	// get to look them up once the client IP is out of requests.
+	tokens := []string{"garbage", strings.Repeat("A", 26), strings.Repeat("B", 26)}
+	want := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+
+	for i, status := range want {
+		res := ts.do(t, http.MethodGet, "/v1/movies", nil, tokens[i])
+		if res.status != status {
+			t.Errorf("request %d: got status %d, want %d: %s", i+1, res.status, status, res.body)
+		}
+	}
+}
+
+func TestRateLimitingAuthentication(t *testing.T) {
+	ts := newTestServer(t, func(appcfg *config.AppConfig) {
+		appcfg.Limiter.Enabled = true
+		appcfg.Limiter.Rps = 100
+		appcfg.Limiter.Burst = 100
+		appcfg.Limiter.AuthRps = 0.1
+		appcfg.Limiter.AuthBurst = 2
+	})
+
+	credentials := map[string]string{"email": "nobody@example.com", "password": "wrongpassword"}
+
+	want := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+
+	for i, status := range want {
+		res := ts.do(t, http.MethodPost, "/v1/users/authentication", credentials, "")
+		if res.status != status {
+			t.Errorf("request %d: got status %d, want %d: %s", i+1, res.status, status, res.body)
+		}
+	}
+
+	res := ts.do(t, http.MethodGet, "/v1/healthcheck", nil, "")
+	if res.status != http.StatusOK {
+		t.Errorf("other route: got status %d, want %d", res.status, http.StatusOK)
+	}
+}
+
+func TestRateLimitingTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []netip.Prefix
+		wantOK  int
+	}{
+		{name: "untrusted", trusted: nil, wantOK: 1},
+		{name: "trusted", trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}, wantOK: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, func(appcfg *config.AppConfig) {
+				appcfg.Limiter.Enabled = true
+				appcfg.Limiter.Rps = 0.1
+				appcfg.Limiter.Burst = 1
+				appcfg.Limiter.TrustedProxies = tt.trusted
+			})
+
+			ok := 0
+			for _, client := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/healthcheck", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The leftmost hop is forged and must be ignored either way.
+				req.Header.Set("X-Forwarded-For", "198.51.100.7, "+client)
+
+				if res := ts.send(t, req); res.status == http.StatusOK {
+					ok++
+				}
+			}
+
+			if ok != tt.wantOK {
+				t.Errorf("got %d requests allowed, want %d", ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	routes := getRoutes(app)
+	routes.Get("/v1/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("something went very wrong")
+	})
+
+	ts := &testServer{Server: newHTTPTestServer(t, routes), app: app}
+
+	res := ts.do(t, http.MethodGet, "/v1/panic", nil, "")
+	if res.status != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want %d: %s", res.status, http.StatusInternalServerError, res.body)
+	}
+
+	if !res.close {
+		t.Error("connection was not closed after the panic")
+	}
+
+	if _, found := res.decode(t)["error"]; !found {
+		t.Errorf("response has no error envelope: %s", res.body)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,15 +12,59 @@ import (
 	"time"
 
 	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/ratelimit"
 )
 
 func serve(app *config.Application) error {
+	// Every request context derives from base, which is cancelled with
+	// config.ErrShuttingDown once the shutdown grace period is over so queries
+	// still running are abandoned rather than left to hold connections open.
+	base, cancelBase := context.WithCancelCause(context.Background())
+	defer cancelBase(nil)
+
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%v", app.Config.Port),
 		Handler:      getRoutes(app),
 		IdleTimeout:  2 * time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 20 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return base },
+	}
+
+	// Forget rate limiter clients that went quiet, so the buckets do not grow
+	// with every address that ever made a request.
+	if idle := app.Config.Limiter.IdleTimeout; idle > 0 {
+		go ratelimit.Sweep(base, app.Limiter, idle, func(err error) {
+			app.Logger.PrintError(err, map[string]string{"task": "rate limiter sweep"})
+		})
+	}
+
+	go app.SweepIdempotencyKeys(base, time.Hour)
+
+	// The admin listener shares the lifetime of the main server. Profiles can
+	// take 30 seconds and more, hence the longer write timeout.
+	var debugServer *http.Server
+	if app.Config.Debug.Addr != "" {
+		debugServer = &http.Server{
+			Addr:         app.Config.Debug.Addr,
+			Handler:      getDebugRoutes(app),
+			IdleTimeout:  2 * time.Minute,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 2 * time.Minute,
+		}
+
+		go func() {
+			app.Logger.PrintInfo("starting debug server", map[string]string{
+				"addr": debugServer.Addr,
+			})
+
+			err := debugServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.Logger.PrintError(err, map[string]string{
+					"addr": debugServer.Addr,
+				})
+			}
+		}()
 	}
 
 	shutdownError := make(chan error)
@@ -35,10 +80,25 @@ func serve(app *config.Application) error {
 			"signal": s.String(),
 		})
 
+		// Fail readiness first and keep serving for a moment, so load
+		// balancers stop routing here before the listener goes away.
+		app.ShuttingDown.Store(true)
+		if delay := app.Config.Health.ShutdownDelay; delay > 0 {
+			app.Logger.PrintInfo("reporting not ready before shutdown", map[string]string{
+				"delay": delay.String(),
+			})
+			time.Sleep(delay)
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
+		if debugServer != nil {
+			debugServer.Close()
+		}
+
 		err := server.Shutdown(ctx)
+		cancelBase(config.ErrShuttingDown)
 		if err != nil {
 			shutdownError <- err
 		}
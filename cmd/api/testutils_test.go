@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/jsonlog"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/migrate"
+	"github.com/3WDeveloper-GM/json-endpoints/migrations"
+)
+
+// The suite runs against the in-memory repositories by default. Setting
+// TEST_DB_DSN points it at a real Postgres instead: every test gets its own
+// throwaway schema migrated by internal/migrate, which is dropped afterwards.
+const testDSNEnv = "TEST_DB_DSN"
+
+// recordingTokens wraps a token repository and remembers the plaintext of every
+// token it issues, standing in for the inbox the activation email goes to.
+type recordingTokens struct {
+	data.TokenRepository
+
+	mu     sync.Mutex
+	issued map[int64]map[string]string
+}
+
+func (rt *recordingTokens) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	token, err := rt.TokenRepository.New(ctx, userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.issued[userID] == nil {
+		rt.issued[userID] = make(map[string]string)
+	}
+	rt.issued[userID][scope] = token.Plaintext
+
+	return token, nil
+}
+
+func (rt *recordingTokens) latest(userID int64, scope string) string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	return rt.issued[userID][scope]
+}
+
+type testServer struct {
+	*httptest.Server
+	app    *config.Application
+	tokens *recordingTokens
+}
+
+// newTestApplication builds an Application the way initConfig does, with the
+// rate limiter off, logs discarded and a mailer pointed at a closed port so the
+// welcome email fails fast in the background.
+func newTestApplication(t *testing.T, configure ...func(*config.AppConfig)) (*config.Application, *recordingTokens) {
+	t.Helper()
+
+	appcfg := &config.AppConfig{Port: 4000, Version: "test", Mode: "testing", Storage: "memory"}
+	appcfg.Limiter.Rps = 2
+	appcfg.Limiter.Burst = 4
+	appcfg.Pagination.CursorSecret = "e2e-cursor-secret"
+	appcfg.Search.Config = "english"
+	appcfg.SMTP.Host = "127.0.0.1"
+	appcfg.SMTP.Port = 1
+	appcfg.SMTP.Sender = "Greenlight <no-reply@greenlight.test>"
+	appcfg.Health.Timeout = 2 * time.Second
+	appcfg.Idempotency.TTL = time.Hour
+
+	for _, fn := range configure {
+		fn(appcfg)
+	}
+
+	applog := &config.AppLoggers{}
+	applog.SetStructConfig(io.Discard, jsonlog.LevelOff)
+
+	appsmtp := &config.AppSMTP{}
+	appsmtp.SetStructConfig(appcfg)
+
+	appmodel := &config.AppModels{}
+	if dsn := os.Getenv(testDSNEnv); dsn != "" {
+		appmodel.SetStructConfig(newTestDB(t, dsn), appcfg)
+	} else {
+		appmodel.SetMemoryConfig()
+	}
+
+	appmetrics := &config.AppMetrics{}
+	appmetrics.SetStructConfig(appmodel.DB)
+
+	tokens := &recordingTokens{TokenRepository: appmodel.Tokens, issued: make(map[int64]map[string]string)}
+	appmodel.Tokens = tokens
+
+	app := &config.Application{}
+	applimiter := &config.AppLimiter{}
+	applimiter.SetStructConfig(appcfg, appmodel.DB, applog, appmetrics)
+
+	app.SetStructConfig(appcfg, applog, appmodel, appsmtp, appmetrics, applimiter)
+
+	t.Cleanup(app.Wait)
+
+	return app, tokens
+}
+
+func newTestServer(t *testing.T, configure ...func(*config.AppConfig)) *testServer {
+	t.Helper()
+
+	app, tokens := newTestApplication(t, configure...)
+
+	return &testServer{Server: newHTTPTestServer(t, getRoutes(app)), app: app, tokens: tokens}
+}
+
+func newHTTPTestServer(t *testing.T, h http.Handler) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// newTestDB creates a private schema, migrates it to the latest version and
+// returns a pool whose connections only see that schema (plus public, where
+// extensions live).
+func newTestDB(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+
+	suffix := make([]byte, 6)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "e2e_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	for _, stmt := range []string{
+		"CREATE EXTENSION IF NOT EXISTS citext",
+		"CREATE SCHEMA " + schema,
+	} {
+		if _, err := admin.Exec(stmt); err != nil {
+			t.Fatalf("preparing test database: %v", err)
+		}
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema+",public")
+	u.RawQuery = q.Encode()
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+
+		admin, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return
+		}
+		defer admin.Close()
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+	})
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = migrator.Up(context.Background())
+	if err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+
+	return db
+}
+
+type testResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	close  bool
+}
+
+func (tr testResponse) decode(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	var envelope map[string]interface{}
+	err := json.Unmarshal(tr.body, &envelope)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", tr.body, err)
+	}
+	return envelope
+}
+
+// do sends a request with an optional JSON body (strings are sent verbatim)
+// and bearer token.
+func (ts *testServer) do(t *testing.T, method, path string, body interface{}, token string) testResponse {
+	t.Helper()
+
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(body)
+	default:
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return ts.send(t, req)
+}
+
+func (ts *testServer) send(t *testing.T, req *http.Request) testResponse {
+	t.Helper()
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testResponse{status: res.StatusCode, header: res.Header, body: body, close: res.Close}
+}
+
+// registerUser signs a user up and returns its id.
+func (ts *testServer) registerUser(t *testing.T, name, email, password string) int64 {
+	t.Helper()
+
+	res := ts.do(t, http.MethodPost, "/v1/users", map[string]string{"name": name, "email": email, "password": password}, "")
+	if res.status != http.StatusAccepted {
+		t.Fatalf("registering %s: got status %d: %s", email, res.status, res.body)
+	}
+
+	user := res.decode(t)["user"].(map[string]interface{})
+	return int64(user["id"].(float64))
+}
+
+// activatedUserToken registers and activates a user, then logs in and returns
+// the authentication token.
+func (ts *testServer) activatedUserToken(t *testing.T, email string) string {
+	t.Helper()
+
+	id := ts.registerUser(t, "Test User", email, "pa55word1234")
+
+	res := ts.do(t, http.MethodPut, "/v1/users/activated", map[string]string{"token": ts.tokens.latest(id, data.ScopeActivation)}, "")
+	if res.status != http.StatusOK {
+		t.Fatalf("activating %s: got status %d: %s", email, res.status, res.body)
+	}
+
+	return ts.login(t, email, "pa55word1234")
+}
+
+func (ts *testServer) login(t *testing.T, email, password string) string {
+	t.Helper()
+
+	res := ts.do(t, http.MethodPost, "/v1/users/authentication", map[string]string{"email": email, "password": password}, "")
+	if res.status != http.StatusCreated {
+		t.Fatalf("authenticating %s: got status %d: %s", email, res.status, res.body)
+	}
+
+	return res.decode(t)["auth_token"].(map[string]interface{})["token"].(string)
+}
+
+// createMovie adds a movie through the API and returns its id.
+func (ts *testServer) createMovie(t *testing.T, token, title string, year int, runtime int, genres ...string) int64 {
+	t.Helper()
+
+	movie := map[string]interface{}{
+		"title":   title,
+		"year":    year,
+		"runtime": fmt.Sprintf("%d mins", runtime),
+		"genres":  genres,
+	}
+
+	res := ts.do(t, http.MethodPost, "/v1/movies", movie, token)
+	if res.status != http.StatusOK {
+		t.Fatalf("creating %q: got status %d: %s", title, res.status, res.body)
+	}
+
+	return int64(res.decode(t)["movie"].(map[string]interface{})["id"].(float64))
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
 )
 
@@ -33,7 +34,7 @@ func createAuthenticationTokenPost(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		user, err := app.Models.Users.GetByEmail(input.Email)
+		user, err := app.Models.Users.GetByEmail(r.Context(), input.Email)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -44,7 +45,9 @@ func createAuthenticationTokenPost(app *config.Application) http.HandlerFunc {
 			return
 		}
 
+		_, span := tracing.Start(r.Context(), "bcrypt.CompareHashAndPassword")
 		match, err := user.Password.Matches(input.Password)
+		span.End()
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
@@ -55,13 +58,13 @@ func createAuthenticationTokenPost(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		token, err := app.Models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+		token, err := app.Models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
 		}
 
-		err = app.JsonWriter(w, http.StatusCreated, config.Envelope{"auth_token": token}, nil)
+		err = app.JsonWriter(w, r, http.StatusCreated, config.Envelope{"auth_token": token}, nil)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 		}
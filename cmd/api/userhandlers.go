@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
 
 	"github.com/3WDeveloper-GM/json-endpoints/cmd/config"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
 )
 
@@ -21,7 +23,7 @@ func userRegisterPost(app *config.Application) http.HandlerFunc {
 
 		err := app.JsonReader(w, r, &input)
 		if err != nil {
-			app.InternalSErrorResponse(w, r, err)
+			app.BadRequestResponse(w, r, err)
 			return
 		}
 
@@ -31,7 +33,9 @@ func userRegisterPost(app *config.Application) http.HandlerFunc {
 			Activated: false,
 		}
 
+		_, span := tracing.Start(r.Context(), "bcrypt.GenerateFromPassword")
 		err = user.Password.Set(input.Password)
+		span.End()
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
@@ -44,11 +48,11 @@ func userRegisterPost(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		err = app.Models.Users.Insert(user)
+		err = app.Models.Users.Insert(r.Context(), user)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrDuplicateEmail):
-				v.AddError("email", "a user with this email already exists")
+				v.AddError("email", validator.CodeAlreadyExists, nil)
 				app.FailedValidationResponse(w, r, v.Errors)
 			default:
 				app.InternalSErrorResponse(w, r, err)
@@ -56,26 +60,29 @@ func userRegisterPost(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		token, err := app.Models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		token, err := app.Models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
 		}
 
-		app.Background(func() {
+		app.Background(r.Context(), func(ctx context.Context) {
 
 			data := map[string]interface{}{
 				"activationToken": token.Plaintext,
 				"userID":          user.ID,
 			}
 
-			err = app.Mailer.Send(user.Email, "usr_welcome.tmpl", data)
+			err := app.Mailer.Send(ctx, user.Email, "usr_welcome.tmpl", data)
 			if err != nil {
+				app.Metrics.MailerSends.Inc("failure")
 				app.Logger.PrintError(err, nil)
+				return
 			}
+			app.Metrics.MailerSends.Inc("success")
 		})
 
-		err = app.JsonWriter(w, http.StatusAccepted, config.Envelope{"user": user}, nil)
+		err = app.JsonWriter(w, r, http.StatusAccepted, config.Envelope{"user": user}, nil)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 		}
@@ -101,11 +108,11 @@ func activateUserPut(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		user, err := app.Models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+		user, err := app.Models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				v.AddError("token", "invalid or expired activation token")
+				v.AddError("token", validator.CodeInvalidToken, nil)
 				app.FailedValidationResponse(w, r, v.Errors)
 			default:
 				app.InternalSErrorResponse(w, r, err)
@@ -115,7 +122,7 @@ func activateUserPut(app *config.Application) http.HandlerFunc {
 
 		user.Activated = true
 
-		err = app.Models.Users.Update(user)
+		err = app.Models.Users.Update(r.Context(), user)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrEditConflict):
@@ -126,13 +133,13 @@ func activateUserPut(app *config.Application) http.HandlerFunc {
 			return
 		}
 
-		err = app.Models.Tokens.DeleteForAllUser(data.ScopeActivation, user.ID)
+		err = app.Models.Tokens.DeleteForAllUser(r.Context(), data.ScopeActivation, user.ID)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 			return
 		}
 
-		err = app.JsonWriter(w, http.StatusOK, config.Envelope{"user": user}, nil)
+		err = app.JsonWriter(w, r, http.StatusOK, config.Envelope{"user": user}, nil)
 		if err != nil {
 			app.InternalSErrorResponse(w, r, err)
 		}
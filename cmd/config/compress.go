@@ -0,0 +1,236 @@
+package config
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// compressor is what gzip.Writer and zlib.Writer have in common, which
+// lets finished writers be reset and reused.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// contentEncoding is a Content-Encoding the API can produce. Another coding
+// such as br only needs an entry in contentEncodings.
+type contentEncoding struct {
+	name string
+	pool *sync.Pool
+}
+
+func encodingPool(fn func() compressor) *sync.Pool {
+	return &sync.Pool{New: func() interface{} { return fn() }}
+}
+
+// contentEncodings are listed in order of preference, for clients that
+// accept several with the same weight. The HTTP deflate coding is the zlib
+// format, not raw deflate.
+var contentEncodings = []contentEncoding{
+	{name: "gzip", pool: encodingPool(func() compressor { return gzip.NewWriter(nil) })},
+	{name: "deflate", pool: encodingPool(func() compressor { return zlib.NewWriter(nil) })},
+}
+
+// negotiateEncoding picks the coding the Accept-Encoding header prefers, or
+// nil to send the response as is.
+func negotiateEncoding(header string) *contentEncoding {
+	accept := parseQualityValues(header)
+
+	var (
+		chosen  *contentEncoding
+		chosenQ float64
+	)
+
+	for i, encoding := range contentEncodings {
+		q, matched := 0.0, false
+		for _, qv := range accept {
+			if qv.value == encoding.name {
+				q, matched = qv.q, true
+				break
+			}
+			if qv.value == "*" && !matched {
+				q = qv.q
+			}
+		}
+
+		if q > chosenQ {
+			chosen, chosenQ = &contentEncodings[i], q
+		}
+	}
+
+	return chosen
+}
+
+// compressibleTypes are the media types worth compressing. Images, archives
+// and the like are compressed already.
+var compressibleTypes = []string{
+	"application/json",
+	"application/x-ndjson",
+	"application/msgpack",
+	"application/cbor",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") {
+		return true
+	}
+
+	for _, t := range compressibleTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter holds the response back until minSize bytes are written, so
+// small bodies that would not shrink are sent as they are. Flushing ends the
+// wait, since it means the handler is streaming.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding *contentEncoding
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+	c       compressor
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.started {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.started {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+
+		err := cw.start(true)
+		return len(b), err
+	}
+
+	if cw.c != nil {
+		return cw.c.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// start sends the headers, compressed if compress allows and the response
+// qualifies, followed by whatever was held back.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if compress && status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding.name)
+		h.Del("Content-Length")
+
+		cw.c = cw.encoding.pool.Get().(compressor)
+		cw.c.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+
+	buf := cw.buf
+	cw.buf = nil
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	_, err := cw.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		cw.start(true)
+	}
+	if cw.c != nil {
+		cw.c.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close sends a response that stayed under the threshold as it is, or ends
+// the compressed stream.
+func (cw *compressWriter) Close() error {
+	if !cw.started {
+		return cw.start(false)
+	}
+
+	if cw.c == nil {
+		return nil
+	}
+
+	err := cw.c.Close()
+	cw.c.Reset(nil)
+	cw.encoding.pool.Put(cw.c)
+	cw.c = nil
+
+	return err
+}
+
+// Compress encodes responses of at least -compress-min-size bytes with the
+// best coding the client accepts in Accept-Encoding.
+func (app *Application) Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Config.Compression.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == nil || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: app.Config.Compression.MinSize}
+
+		defer func() {
+			err := cw.Close()
+			if err != nil {
+				app.ErrLog(r, err)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -4,13 +4,17 @@ import (
 	"database/sql"
 	"flag"
 	"io"
+	"net/netip"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/jsonlog"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/mailer"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/ratelimit"
 	"github.com/go-mail/mail/v2"
 	_ "github.com/lib/pq"
 )
@@ -26,27 +30,53 @@ type NewStruct interface {
 }
 
 type Application struct {
-	Config *AppConfig
-	Logger *AppLoggers
-	Models *AppModels
-	Mailer *AppSMTP
+	Config  *AppConfig
+	Logger  *AppLoggers
+	Models  *AppModels
+	Mailer  *AppSMTP
+	Metrics *AppMetrics
+	Limiter *AppLimiter
 	sync.WaitGroup
+
+	// ShuttingDown is set by serve() as soon as a termination signal arrives,
+	// so readiness checks fail while in-flight requests drain.
+	ShuttingDown atomic.Bool
 }
 
 type AppConfig struct {
 	Port     int
 	Version  string
 	Mode     string
+	Storage  string
 	Database struct {
-		Dsn          string
-		MaxIdleConns int
-		MaxOpenConns int
-		MaxIdleTime  string
+		Dsn            string
+		MaxIdleConns   int
+		MaxOpenConns   int
+		MaxIdleTime    string
+		MaxLifetime    string
+		ConnectTimeout time.Duration
+		MigrateOnStart bool
+		QueryTimeout   time.Duration
 	}
 	Limiter struct {
-		Rps     float64
-		Burst   int
-		Enabled bool
+		Rps            float64
+		Burst          int
+		Enabled        bool
+		UserRps        float64
+		UserBurst      int
+		AuthRps        float64
+		AuthBurst      int
+		IdleTimeout    time.Duration
+		TrustedProxies []netip.Prefix
+		Store          string
+		StoreTimeout   time.Duration
+		Cooldown       time.Duration
+	}
+	Pagination struct {
+		CursorSecret string
+	}
+	Search struct {
+		Config string
 	}
 	SMTP struct {
 		Host     string
@@ -55,6 +85,34 @@ type AppConfig struct {
 		Password string
 		Sender   string
 	}
+	Health struct {
+		Timeout       time.Duration
+		CheckSMTP     bool
+		ShutdownDelay time.Duration
+	}
+	Debug struct {
+		Addr     string
+		Username string
+		Password string
+	}
+	CORS struct {
+		TrustedOrigins   []string
+		AllowCredentials bool
+		MaxAge           time.Duration
+	}
+	Idempotency struct {
+		TTL time.Duration
+	}
+	Compression struct {
+		Enabled bool
+		MinSize int
+	}
+	Tracing struct {
+		Exporter     string
+		File         string
+		OTLPEndpoint string
+		ServiceName  string
+	}
 }
 
 type AppLoggers struct {
@@ -65,8 +123,13 @@ type AppSMTP struct {
 	mailer.Mailer
 }
 
+type AppLimiter struct {
+	ratelimit.Limiter
+}
+
 type AppModels struct {
 	data.Models
+	DB *sql.DB
 }
 
 // SetStructConfig interface for the main application struct
@@ -76,17 +139,50 @@ func (appcfg *AppConfig) SetStructConfig(version string) {
 	flag.IntVar(&appcfg.Port, "port", 4000, "API server port")
 	flag.StringVar(&appcfg.Mode, "env", "development", "Environment (development|staging|production)")
 
-	//database configurations
+	//storage and database configurations
+	flag.StringVar(&appcfg.Storage, "storage", "postgres", "Storage backend (postgres|memory), memory keeps everything in process for demos and tests")
 	flag.StringVar(&appcfg.Database.Dsn, "db-dsn", os.Getenv("TESTING_DSN"), "PostgreSQL DSN")
 
 	flag.IntVar(&appcfg.Database.MaxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.IntVar(&appcfg.Database.MaxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.StringVar(&appcfg.Database.MaxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.StringVar(&appcfg.Database.MaxLifetime, "db-max-lifetime", "1h", "PostgreSQL max connection lifetime (0 keeps connections forever)")
+	flag.DurationVar(&appcfg.Database.ConnectTimeout, "db-connect-timeout", 30*time.Second, "how long to keep retrying the first PostgreSQL connection at startup")
+	flag.DurationVar(&appcfg.Database.QueryTimeout, "db-query-timeout", data.DefaultQueryTimeout, "PostgreSQL per-query timeout, on top of the request being cancelled")
+	flag.BoolVar(&appcfg.Database.MigrateOnStart, "migrate-on-start", false, "apply pending embedded migrations before serving")
 
 	//rate limiter configurations
 	flag.Float64Var(&appcfg.Limiter.Rps, "rps", 2, "rate limiter maximum requests per second")
 	flag.IntVar(&appcfg.Limiter.Burst, "burst", 4, "rate limiter maximum burst")
 	flag.BoolVar(&appcfg.Limiter.Enabled, "limited-enabled", true, "rate limiter enabler")
+	flag.Float64Var(&appcfg.Limiter.UserRps, "limiter-user-rps", 10, "rate limiter requests per second for authenticated users, counted per user")
+	flag.IntVar(&appcfg.Limiter.UserBurst, "limiter-user-burst", 20, "rate limiter burst for authenticated users")
+	flag.Float64Var(&appcfg.Limiter.AuthRps, "limiter-auth-rps", 0.2, "rate limiter requests per second on /v1/users/authentication, counted per IP")
+	flag.IntVar(&appcfg.Limiter.AuthBurst, "limiter-auth-burst", 5, "rate limiter burst on /v1/users/authentication")
+	flag.DurationVar(&appcfg.Limiter.IdleTimeout, "limiter-idle-timeout", 3*time.Minute, "forget clients that made no request for this long")
+	flag.StringVar(&appcfg.Limiter.Store, "limiter-store", "local", "where token buckets live (local|postgres), postgres shares them between replicas")
+	flag.DurationVar(&appcfg.Limiter.StoreTimeout, "limiter-store-timeout", 100*time.Millisecond, "longest a shared store query may take before the replica limits locally")
+	flag.DurationVar(&appcfg.Limiter.Cooldown, "limiter-store-cooldown", 10*time.Second, "how long to limit locally after the shared store fails before trying it again")
+	flag.Func("limiter-trusted-proxies", "proxies whose X-Forwarded-For is believed, as space separated IPs or CIDRs", func(val string) error {
+		for _, field := range strings.Fields(val) {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(field)
+				if aerr != nil {
+					return err
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			appcfg.Limiter.TrustedProxies = append(appcfg.Limiter.TrustedProxies, prefix.Masked())
+		}
+		return nil
+	})
+
+	//pagination configurations
+	flag.StringVar(&appcfg.Pagination.CursorSecret, "cursor-secret", os.Getenv("CURSOR_SECRET"), "secret used to sign pagination cursors (random per process when empty)")
+
+	//full-text search configurations
+	flag.StringVar(&appcfg.Search.Config, "search-config", "english", "default text search configuration (english|simple)")
 
 	//SMTP configuration flags
 	flag.StringVar(&appcfg.SMTP.Host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
@@ -95,6 +191,37 @@ func (appcfg *AppConfig) SetStructConfig(version string) {
 	flag.StringVar(&appcfg.SMTP.Password, "smtp-password", "756080f5f1c2c3", "SMTP password")
 	flag.StringVar(&appcfg.SMTP.Sender, "smtp-sender", "Greenlight <no-reply@greenlight.3wdevel.net>", "SMTP sender address")
 
+	//health check configurations
+	flag.DurationVar(&appcfg.Health.Timeout, "health-timeout", 2*time.Second, "timeout for each dependency checked by /v1/health/ready")
+	flag.BoolVar(&appcfg.Health.CheckSMTP, "health-check-smtp", false, "include the SMTP server in the readiness check")
+	flag.DurationVar(&appcfg.Health.ShutdownDelay, "shutdown-delay", 0, "how long to report not ready before shutting down, giving load balancers time to notice")
+
+	//debug listener configurations
+	flag.StringVar(&appcfg.Debug.Addr, "debug-addr", "", "address of the admin listener serving /metrics, /debug/vars and /debug/pprof, e.g. localhost:4001 (disabled when empty)")
+	flag.StringVar(&appcfg.Debug.Username, "debug-username", "", "basic auth username for the admin listener (no auth when empty, only allowed on a loopback -debug-addr)")
+	flag.StringVar(&appcfg.Debug.Password, "debug-password", os.Getenv("DEBUG_PASSWORD"), "basic auth password for the admin listener")
+
+	//CORS configurations
+	flag.Func("cors-trusted-origins", "trusted CORS origins, space separated (\"*\" allows any origin)", func(val string) error {
+		appcfg.CORS.TrustedOrigins = strings.Fields(val)
+		return nil
+	})
+	flag.BoolVar(&appcfg.CORS.AllowCredentials, "cors-allow-credentials", false, "let trusted origins send cookies and authorization headers")
+	flag.DurationVar(&appcfg.CORS.MaxAge, "cors-max-age", 10*time.Minute, "how long browsers may cache a preflight response")
+
+	//compression configurations
+	flag.BoolVar(&appcfg.Compression.Enabled, "compress", true, "compress responses for clients sending Accept-Encoding")
+	flag.IntVar(&appcfg.Compression.MinSize, "compress-min-size", 1024, "smallest response body, in bytes, worth compressing")
+
+	//idempotency configurations
+	flag.DurationVar(&appcfg.Idempotency.TTL, "idempotency-ttl", 24*time.Hour, "how long responses are kept for replay to retries carrying the same Idempotency-Key")
+
+	//tracing configurations
+	flag.StringVar(&appcfg.Tracing.Exporter, "trace-exporter", "none", "where to send trace spans (none|stdout|file|otlp)")
+	flag.StringVar(&appcfg.Tracing.File, "trace-file", "traces.jsonl", "file the file exporter appends spans to")
+	flag.StringVar(&appcfg.Tracing.OTLPEndpoint, "trace-otlp-endpoint", "http://localhost:4318", "OTLP/HTTP collector base URL for the otlp exporter")
+	flag.StringVar(&appcfg.Tracing.ServiceName, "trace-service-name", "greenlight", "service.name reported with every span")
+
 }
 
 func (appsmtp *AppSMTP) SetStructConfig(appcfg *AppConfig) {
@@ -110,16 +237,46 @@ func (applog *AppLoggers) SetStructConfig(out io.Writer, min jsonlog.Level) {
 }
 
 // Interface for configuring the model struct, for the CRUD operations
-func (appModel *AppModels) SetStructConfig(db *sql.DB) {
-	appModel.Movies = data.MovieModel{DB: db}
-	appModel.Users = data.UserModel{DB: db}
-	appModel.Tokens = data.TokenModel{DB: db}
+func (appModel *AppModels) SetStructConfig(db *sql.DB, appcfg *AppConfig) {
+	appModel.Models = data.NewModels(db, appcfg.Database.QueryTimeout)
+	appModel.DB = db
+}
+
+// Configures the model struct with the in-memory repositories instead of Postgres
+func (appModel *AppModels) SetMemoryConfig() {
+	appModel.Models = data.NewMemoryModels()
+}
+
+// Configures the token buckets used by the rate limiting middleware. With
+// -limiter-store postgres the buckets are shared through db, and the replica
+// limits on its own while the database cannot be reached.
+func (applimiter *AppLimiter) SetStructConfig(appcfg *AppConfig, db *sql.DB, applog *AppLoggers, appmetrics *AppMetrics) {
+	local := ratelimit.NewLocal(appcfg.Limiter.IdleTimeout)
+
+	if appcfg.Limiter.Store != "postgres" || db == nil {
+		applimiter.Limiter = local
+		return
+	}
+
+	fallback := ratelimit.NewFallback(ratelimit.NewPostgres(db, appcfg.Limiter.StoreTimeout), local, appcfg.Limiter.Cooldown)
+	fallback.OnError = func(err error) {
+		appmetrics.RateLimitStoreErrors.Inc()
+		applog.PrintError(err, map[string]string{
+			"limiter_store": appcfg.Limiter.Store,
+			"fallback":      "local",
+			"cooldown":      appcfg.Limiter.Cooldown.String(),
+		})
+	}
+
+	applimiter.Limiter = fallback
 }
 
 // Interface for getting the configuration of the main application struct
-func (app *Application) SetStructConfig(appcfg *AppConfig, applog *AppLoggers, appModel *AppModels, appsmtp *AppSMTP) {
+func (app *Application) SetStructConfig(appcfg *AppConfig, applog *AppLoggers, appModel *AppModels, appsmtp *AppSMTP, appmetrics *AppMetrics, applimiter *AppLimiter) {
 	app.Config = appcfg
 	app.Logger = applog
 	app.Models = appModel
 	app.Mailer = appsmtp
+	app.Metrics = appmetrics
+	app.Limiter = applimiter
 }
@@ -3,15 +3,31 @@ package config
 import (
 	"context"
 	"net/http"
+	"strconv"
 
 	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
 )
 
 type contextkey string
 
-const userCtxKey = contextkey("user")
+const (
+	userCtxKey        = contextkey("user")
+	requestInfoCtxKey = contextkey("request_info")
+)
+
+// requestInfo is shared by pointer between the middleware that creates it and
+// everything further down the chain, so the access log written on the way
+// out sees the user that Authenticate attached on the way in.
+type requestInfo struct {
+	id     string
+	userID int64
+}
 
 func (app *Application) ContextSetUser(r *http.Request, user *data.User) *http.Request {
+	if info, ok := r.Context().Value(requestInfoCtxKey).(*requestInfo); ok && !user.IsAnonymous() {
+		info.userID = user.ID
+	}
+
 	ctx := context.WithValue(r.Context(), userCtxKey, user)
 	return r.WithContext(ctx)
 }
@@ -23,3 +39,28 @@ func (app *Application) ContextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *Application) ContextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoCtxKey, &requestInfo{id: id})
+	return r.WithContext(ctx)
+}
+
+// ContextGetRequestID returns the request ID, or an empty string for requests
+// that did not go through the RequestID middleware.
+func (app *Application) ContextGetRequestID(r *http.Request) string {
+	info, ok := r.Context().Value(requestInfoCtxKey).(*requestInfo)
+	if !ok {
+		return ""
+	}
+	return info.id
+}
+
+// contextGetUserID returns the ID of the authenticated user as a string, or an
+// empty string for anonymous requests.
+func (app *Application) contextGetUserID(r *http.Request) string {
+	info, ok := r.Context().Value(requestInfoCtxKey).(*requestInfo)
+	if !ok || info.userID == 0 {
+		return ""
+	}
+	return strconv.FormatInt(info.userID, 10)
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// expvar keeps a single process wide namespace and panics on duplicate
+// names, so the variables are published once no matter how many
+// Applications get built, as happens in the tests.
+var (
+	publishOnce sync.Once
+
+	totalRequestsReceived           = new(expvar.Int)
+	totalResponsesSent              = new(expvar.Int)
+	totalProcessingTimeMicroseconds = new(expvar.Int)
+	totalResponsesSentByStatus      = new(expvar.Map).Init()
+)
+
+// PublishExpvars registers the variables served at /debug/vars next to the
+// cmdline and memstats ones the expvar package always provides.
+func (app *Application) PublishExpvars() {
+	publishOnce.Do(func() {
+		expvar.Publish("version", expvar.Func(func() interface{} { return app.Config.Version }))
+		expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+		expvar.Publish("timestamp", expvar.Func(func() interface{} { return time.Now().Unix() }))
+		expvar.Publish("database", expvar.Func(func() interface{} {
+			if app.Models.DB == nil {
+				return nil
+			}
+			return app.Models.DB.Stats()
+		}))
+
+		expvar.Publish("total_requests_received", totalRequestsReceived)
+		expvar.Publish("total_responses_sent", totalResponsesSent)
+		expvar.Publish("total_processing_time_us", totalProcessingTimeMicroseconds)
+		expvar.Publish("total_responses_sent_by_status", totalResponsesSentByStatus)
+	})
+}
+
+// countExpvars feeds the response counters, called by RecordMetrics once the
+// status of a response is known.
+func countExpvars(status int, elapsed time.Duration) {
+	totalResponsesSent.Add(1)
+	totalProcessingTimeMicroseconds.Add(elapsed.Microseconds())
+	totalResponsesSentByStatus.Add(strconv.Itoa(status), 1)
+}
+
+// LoopbackAddr reports whether addr only listens on the loopback interface.
+// An empty host listens on every interface, so it is not loopback.
+func LoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// DebugAuth protects the debug listener with HTTP basic authentication when
+// -debug-username is set. Without it initConfig only accepts a loopback
+// -debug-addr. Both sides are hashed before comparing so the
+// comparison takes the same time whatever the lengths.
+func (app *Application) DebugAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.Config.Debug.Username == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if ok {
+			gotUser := sha256.Sum256([]byte(username))
+			gotPass := sha256.Sum256([]byte(password))
+			wantUser := sha256.Sum256([]byte(app.Config.Debug.Username))
+			wantPass := sha256.Sum256([]byte(app.Config.Debug.Password))
+
+			userMatch := subtle.ConstantTimeCompare(gotUser[:], wantUser[:]) == 1
+			passMatch := subtle.ConstantTimeCompare(gotPass[:], wantPass[:]) == 1
+
+			if userMatch && passMatch {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="debug", charset="UTF-8"`)
+		app.InvalidCredentialsResponse(w, r)
+	})
+}
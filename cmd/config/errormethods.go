@@ -1,10 +1,27 @@
 package config
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
 )
 
+// StatusClientClosedRequest is the non-standard status nginx made popular for
+// requests the client abandoned before the response was ready.
+const StatusClientClosedRequest = 499
+
+// ErrShuttingDown is the cause serve cancels request contexts with once the
+// shutdown grace period is over, telling abandoned requests apart from ones
+// whose client went away.
+var ErrShuttingDown = errors.New("server shutting down")
+
 func (app *Application) ServerError(w http.ResponseWriter, err error) {
 	// trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
 	// app.Logger.Error.Output(2, trace)
@@ -24,15 +41,31 @@ func (app *Application) NotFound(w http.ResponseWriter) {
 
 func (app *Application) ErrLog(r *http.Request, err error) {
 	app.Logger.PrintError(err, map[string]string{
+		"request_id":     app.ContextGetRequestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
 }
 
+// ErrorResponse sends message in the {"error": ...} envelope, or as problem
+// details to clients that ask for application/problem+json.
 func (app *Application) ErrorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
+	if wantsProblem(r) {
+		err := app.ProblemResponse(w, r, app.newProblem(r, status, message))
+		if err != nil {
+			app.ErrLog(r, err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
 	envelope := Envelope{"error": message}
 
-	err := app.JsonWriter(w, status, envelope, nil)
+	if id := app.ContextGetRequestID(r); id != "" {
+		envelope["request_id"] = id
+	}
+
+	err := app.JsonWriter(w, r, status, envelope, nil)
 	if err != nil {
 		app.ErrLog(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -40,12 +73,63 @@ func (app *Application) ErrorResponse(w http.ResponseWriter, r *http.Request, st
 }
 
 func (app *Application) InternalSErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// A query abandoned because the request context ended fails either with
+	// the context error or, once Postgres has it, as a cancelled statement.
+	ctx := r.Context()
+	cancelled := ctx.Err() != nil && (errors.Is(err, context.Canceled) || data.IsTimeout(err))
+
+	switch {
+	case cancelled && errors.Is(context.Cause(ctx), ErrShuttingDown):
+		app.ShuttingDownResponse(w, r, err)
+		return
+	case cancelled && errors.Is(context.Cause(ctx), context.Canceled):
+		app.ClientClosedResponse(w, r, err)
+		return
+	case data.IsTimeout(err):
+		app.TimeoutResponse(w, r, err)
+		return
+	}
+
 	app.ErrLog(r, err)
 
 	message := "the server encountered a problem and could not process the request."
 	app.ErrorResponse(w, r, http.StatusInternalServerError, message)
 }
 
+// ClientClosedResponse answers a request the client disconnected from before
+// the response was ready. Nobody is left to read the body, so the status
+// mostly serves the access logs.
+func (app *Application) ClientClosedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.Logger.PrintInfo("request cancelled by the client", map[string]string{
+		"request_id":     app.ContextGetRequestID(r),
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+		"error":          err.Error(),
+	})
+
+	message := "the request was cancelled before it could be processed."
+	app.ErrorResponse(w, r, StatusClientClosedRequest, message)
+}
+
+// ShuttingDownResponse answers a request the server abandoned because it
+// outlived the shutdown grace period.
+func (app *Application) ShuttingDownResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.ErrLog(r, err)
+
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", "1")
+	message := "the server is shutting down and could not finish the request, please try again."
+	app.ErrorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *Application) TimeoutResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.ErrLog(r, err)
+
+	w.Header().Set("Retry-After", "1")
+	message := "the server took too long to process the request, please try again."
+	app.ErrorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *Application) NotFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the resource could not be found."
 	app.ErrorResponse(w, r, http.StatusNotFound, message)
@@ -56,12 +140,46 @@ func (app *Application) MethodNAResponse(w http.ResponseWriter, r *http.Request)
 	app.ErrorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+func (app *Application) NotAcceptableResponse(w http.ResponseWriter, r *http.Request, offers []string) {
+	message := fmt.Sprintf("none of the media types in the Accept header can be served, this resource is available as %s", strings.Join(offers, ", "))
+	app.ErrorResponse(w, r, http.StatusNotAcceptable, message)
+}
+
 func (app *Application) BadRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.ErrorResponse(w, r, http.StatusBadRequest, err.Error())
 }
 
-func (app *Application) FailedValidationResponse(w http.ResponseWriter, r *http.Request, errorMap map[string]string) {
-	app.ErrorResponse(w, r, http.StatusUnprocessableEntity, errorMap)
+// FailedValidationResponse reports every failed check, in the locale the
+// Accept-Language header prefers. Only problem details carry the error codes
+// and their params, the envelope keeps mapping each field to a message.
+func (app *Application) FailedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string][]validator.FieldError) {
+	locale := negotiateLanguage(r.Header.Get("Accept-Language"), validator.Locales()...)
+
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", locale)
+
+	app.ErrorResponse(w, r, http.StatusUnprocessableEntity, validationErrors{errors: errors, locale: locale})
+}
+
+// validationErrors are the failures of a request validation, rendered in
+// locale. The error envelope gets one message per field, the failures of a
+// field joined together, problem details list them one by one.
+type validationErrors struct {
+	errors map[string][]validator.FieldError
+	locale string
+}
+
+func (ve validationErrors) MarshalJSON() ([]byte, error) {
+	messages := make(map[string]string, len(ve.errors))
+	for field, errors := range ve.errors {
+		parts := make([]string, len(errors))
+		for i, e := range errors {
+			parts[i] = e.Message(ve.locale)
+		}
+		messages[field] = strings.Join(parts, "; ")
+	}
+
+	return json.Marshal(messages)
 }
 
 func (app *Application) EditConflictResponse(w http.ResponseWriter, r *http.Request) {
@@ -74,11 +192,29 @@ func (app *Application) RateLimitExceedsResponse(w http.ResponseWriter, r *http.
 	app.ErrorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
-func (app *Application) Background(fn func()) {
+func (app *Application) IdempotencyInFlightResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this Idempotency-Key is still being processed, please retry later"
+	app.ErrorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *Application) IdempotencyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this Idempotency-Key was already used for a different request"
+	app.ErrorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+// Background runs fn in a goroutine the server waits for before exiting. The
+// context fn gets keeps the values and trace of ctx but not its cancellation,
+// since the request it usually comes from ends before the work is done.
+func (app *Application) Background(ctx context.Context, fn func(ctx context.Context)) {
+	ctx, span := tracing.Start(context.WithoutCancel(ctx), "Application.Background")
 
 	app.Add(1)
+	app.Metrics.BackgroundTasks.Inc()
+
 	go func() {
 		defer app.Done()
+		defer app.Metrics.BackgroundTasks.Dec()
+		defer span.End()
 
 		defer func() {
 			if err := recover(); err != nil {
@@ -86,7 +222,7 @@ func (app *Application) Background(fn func()) {
 			}
 		}()
 
-		fn()
+		fn(ctx)
 	}()
 }
 
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
+)
+
+// idempotencyLockTTL bounds how long a key stays claimed by a request that
+// never completes, because the process died halfway through for instance. It
+// comfortably exceeds the write timeout of the server.
+const idempotencyLockTTL = time.Minute
+
+// responseCapture keeps a copy of the body written through it.
+type responseCapture struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (rc *responseCapture) Write(b []byte) (int, error) {
+	n, err := rc.statusRecorder.Write(b)
+	rc.body.Write(b[:n])
+	return n, err
+}
+
+// Idempotent makes POST and PATCH requests from authenticated users safe to
+// retry. The first request carrying an Idempotency-Key runs as usual and its
+// response is stored for -idempotency-ttl; retries with the same key and body
+// get that response replayed instead of running the handler again. Server
+// errors are not stored, so the retry after one gets another chance.
+func (app *Application) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Keys belong to users, anonymous requests are left for the handler
+		// to accept or reject as usual.
+		user := app.ContextGetUser(r)
+		if user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.NewValidator()
+		if data.ValidateIdempotencyKey(v, key); !v.Valid() {
+			app.BadRequestResponse(w, r, fmt.Errorf("the Idempotency-Key header %s", v.Errors["idempotency_key"][0].Message(validator.DefaultLocale)))
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBytes+1))
+		if err != nil {
+			app.BadRequestResponse(w, r, err)
+			return
+		}
+		if len(body) > maxRequestBytes {
+			app.BadRequestResponse(w, r, fmt.Errorf("request body exceeds %d bytes, please make the request smaller", maxRequestBytes))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		requestHash := app.idempotencyHash(r, body)
+
+		stored, err := app.Models.Idempotency.Begin(r.Context(), user.ID, key, requestHash, idempotencyLockTTL)
+		switch {
+		case errors.Is(err, data.ErrIdempotencyInFlight):
+			app.IdempotencyInFlightResponse(w, r)
+			return
+		case errors.Is(err, data.ErrIdempotencyMismatch):
+			app.IdempotencyMismatchResponse(w, r)
+			return
+		case err != nil:
+			app.InternalSErrorResponse(w, r, err)
+			return
+		case stored != nil:
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		// The key is released unless the response gets stored, including
+		// when the handler panics. The request context may be gone by then.
+		ctx := context.WithoutCancel(r.Context())
+		completed := false
+
+		defer func() {
+			if completed {
+				return
+			}
+			err := app.Models.Idempotency.Release(ctx, user.ID, key, requestHash)
+			if err != nil {
+				app.ErrLog(r, err)
+			}
+		}()
+
+		before := w.Header().Clone()
+		rc := &responseCapture{statusRecorder: statusRecorder{ResponseWriter: w}}
+
+		next.ServeHTTP(rc, r)
+
+		status := rc.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if status >= http.StatusInternalServerError || status == StatusClientClosedRequest {
+			return
+		}
+
+		// Only the headers the handler set are stored, the ones added by the
+		// middleware in front are set again on every retry. The body is kept
+		// uncompressed, so the encoding Compress chose does not apply to it.
+		header := make(map[string][]string)
+		for name, values := range w.Header() {
+			if name == "Content-Encoding" || name == "Content-Length" {
+				continue
+			}
+			if !slices.Equal(before[name], values) {
+				header[name] = values
+			}
+		}
+
+		err = app.Models.Idempotency.Complete(ctx, user.ID, key, requestHash, &data.StoredResponse{Status: status, Header: header, Body: rc.body.Bytes()}, app.Config.Idempotency.TTL)
+		if err != nil {
+			app.ErrLog(r, err)
+			return
+		}
+
+		completed = true
+	})
+}
+
+// idempotencyHash identifies a request by its method, URI and body, and by
+// what the stored response depends on besides: the encoding and error format
+// the Accept header picks and the locale Accept-Language picks. A retry that
+// negotiates differently is a different request, not one to replay.
+func (app *Application) idempotencyHash(r *http.Request, body []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	fmt.Fprintf(hash, "%s problem=%t\n", responseCodec(r).MediaType, wantsProblem(r))
+	fmt.Fprintf(hash, "%s\n", negotiateLanguage(r.Header.Get("Accept-Language"), validator.Locales()...))
+	hash.Write(body)
+
+	return hash.Sum(nil)
+}
+
+// SweepIdempotencyKeys deletes expired keys every interval until ctx is done.
+// Expired keys are claimed afresh anyway, this only keeps the storage small.
+func (app *Application) SweepIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := app.Models.Idempotency.DeleteExpired(ctx)
+			if err != nil {
+				app.Logger.PrintError(err, map[string]string{"task": "idempotency key sweep"})
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/metrics"
+	"github.com/go-chi/chi/v5"
+)
+
+type AppMetrics struct {
+	*metrics.Registry
+
+	Requests             *metrics.CounterVec
+	RequestDuration      *metrics.HistogramVec
+	InFlight             *metrics.GaugeVec
+	RateLimited          *metrics.CounterVec
+	RateLimitStoreErrors *metrics.CounterVec
+	BackgroundTasks      *metrics.GaugeVec
+	MailerSends          *metrics.CounterVec
+}
+
+// Registers every metric the API exports. The pool metrics are only added when
+// there is a database, since the in-memory storage has no pool to report on.
+func (appmetrics *AppMetrics) SetStructConfig(db *sql.DB) {
+	registry := metrics.NewRegistry()
+	appmetrics.Registry = registry
+
+	appmetrics.Requests = registry.NewCounterVec("http_requests_total", "HTTP requests handled, by route pattern, method and status.", "route", "method", "status")
+	appmetrics.RequestDuration = registry.NewHistogramVec("http_request_duration_seconds", "Time spent handling HTTP requests, by route pattern, method and status.", metrics.DefBuckets, "route", "method", "status")
+	appmetrics.InFlight = registry.NewGaugeVec("http_requests_in_flight", "HTTP requests currently being handled.")
+	appmetrics.RateLimited = registry.NewCounterVec("ratelimit_rejections_total", "Requests rejected by the rate limiter.")
+	appmetrics.RateLimitStoreErrors = registry.NewCounterVec("ratelimit_store_errors_total", "Failures of the shared rate limiter store, each followed by a period of local limiting.")
+	appmetrics.BackgroundTasks = registry.NewGaugeVec("background_tasks", "Background goroutines started with Application.Background still running.")
+	appmetrics.MailerSends = registry.NewCounterVec("mailer_sends_total", "Emails the mailer attempted to send, by result.", "result")
+
+	// Touch the series known up front so they are scraped as zero rather than
+	// missing until the first event.
+	appmetrics.InFlight.Add(0)
+	appmetrics.RateLimited.Add(0)
+	appmetrics.RateLimitStoreErrors.Add(0)
+	appmetrics.BackgroundTasks.Add(0)
+	appmetrics.MailerSends.Add(0, "success")
+	appmetrics.MailerSends.Add(0, "failure")
+
+	if db == nil {
+		return
+	}
+
+	stats := func(fn func(s sql.DBStats) float64) func() float64 {
+		return func() float64 { return fn(db.Stats()) }
+	}
+
+	registry.NewGaugeFunc("db_pool_max_open_connections", "Maximum number of open connections to the database.", stats(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	registry.NewGaugeFunc("db_pool_open_connections", "Established connections, both in use and idle.", stats(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	registry.NewGaugeFunc("db_pool_in_use_connections", "Connections currently in use.", stats(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	registry.NewGaugeFunc("db_pool_idle_connections", "Idle connections.", stats(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	registry.NewCounterFunc("db_pool_wait_count_total", "Times a query had to wait for a free connection.", stats(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	registry.NewCounterFunc("db_pool_wait_duration_seconds_total", "Time spent waiting for a free connection.", stats(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	registry.NewCounterFunc("db_pool_max_idle_closed_total", "Connections closed because of -db-max-idle-conns.", stats(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	registry.NewCounterFunc("db_pool_max_idle_time_closed_total", "Connections closed because of -db-max-idle-time.", stats(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }))
+	registry.NewCounterFunc("db_pool_max_lifetime_closed_total", "Connections closed because of -db-max-lifetime.", stats(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+}
+
+// statusRecorder remembers the status code and counts the body bytes written
+// through it. It unwraps to the underlying writer so http.ResponseController
+// can still reach Flush and the write deadlines.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// methodLabel keeps the method label bounded, clients can send any token as
+// a method and each one would otherwise start new series.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// RecordMetrics records the count and latency of every request. Requests are
+// labelled by chi route pattern rather than path, so /v1/movies/1 and
+// /v1/movies/2 share a series. Requests that never reached a route, because
+// nothing matched or a middleware such as the rate limiter answered first,
+// are labelled "unmatched", and methods outside the standard set "OTHER".
+func (app *Application) RecordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		totalRequestsReceived.Add(1)
+		app.Metrics.InFlight.Inc()
+		defer app.Metrics.InFlight.Dec()
+
+		sr := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+
+			status := sr.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			elapsed := time.Since(start)
+
+			labels := []string{route, methodLabel(r.Method), strconv.Itoa(status)}
+			app.Metrics.Requests.Inc(labels...)
+			app.Metrics.RequestDuration.Observe(elapsed.Seconds(), labels...)
+			countExpvars(status, elapsed)
+		}()
+
+		next.ServeHTTP(sr, r)
+	})
+}
@@ -1,19 +1,67 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/3WDeveloper-GM/json-endpoints/internal/data"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/ratelimit"
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
-	"golang.org/x/time/rate"
+	"github.com/go-chi/chi/v5"
 )
 
+// Trace starts the server span of every request, continuing the caller's trace
+// when a traceparent header comes with it. The span is renamed after the chi
+// route pattern once routing is done, so spans group by endpoint.
+func (app *Application) Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		remote, _ := tracing.Extract(r.Header)
+
+		ctx, span := tracing.StartServer(r.Context(), r.Method, remote)
+		defer span.End()
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+
+		sr := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			status := sr.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttribute("http.status_code", status)
+
+			if status >= http.StatusInternalServerError {
+				span.RecordError(errors.New(http.StatusText(status)))
+			}
+
+			if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+				span.SetAttribute("http.route", rctx.RoutePattern())
+				span.SetName(r.Method + " " + rctx.RoutePattern())
+			}
+		}()
+
+		next.ServeHTTP(sr, r.WithContext(ctx))
+	})
+}
+
 func (app *Application) RecoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -27,49 +75,184 @@ func (app *Application) RecoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *Application) RateLimiter(next http.Handler) http.Handler {
+// EnableCORS lets browsers on the -cors-trusted-origins call the API. The
+// Origin header is echoed back only when it is trusted, and preflight requests
+// are answered here, before rate limiting and authentication get to them.
+func (app *Application) EnableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+
+		if origin == "" || len(app.Config.CORS.TrustedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed := ""
+		for _, trusted := range app.Config.CORS.TrustedOrigins {
+			if trusted == origin {
+				allowed = origin
+				break
+			}
+			if trusted == "*" {
+				allowed = "*"
+			}
+		}
+
+		if allowed == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, Idempotent-Replayed")
+		// Browsers refuse credentials for a wildcard, which startup already
+		// rejects, so they are only offered to origins trusted by name.
+		if app.Config.CORS.AllowCredentials && allowed != "*" {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, X-Request-ID")
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(app.Config.CORS.MaxAge.Seconds())))
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
 
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+// clientIP returns the address rate limits and logs are keyed on. Requests
+// from one of the -limiter-trusted-proxies are attributed to the address the
+// proxy appended to X-Forwarded-For, walking right to left past other trusted
+// proxies, since anything further left may be forged by the client.
+func (app *Application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
 	}
 
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !app.trustedProxy(remote) {
+		return host
+	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
 
-		if app.Config.Limiter.Enabled {
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				app.InternalSErrorResponse(w, r, err)
-				return
-			}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
 
-			mu.Lock()
+		host = hop.Unmap().String()
+		if !app.trustedProxy(hop) {
+			break
+		}
+	}
 
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.Config.Limiter.Rps), app.Config.Limiter.Burst),
-				}
-			}
+	return host
+}
 
-			clients[ip].lastSeen = time.Now()
+func (app *Application) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
 
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.RateLimitExceedsResponse(w, r)
-				return
-			}
+	for _, prefix := range app.Config.Limiter.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// limit takes a token for key and describes the bucket in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers. It writes the 429 response
+// itself and returns false when the request has to be rejected.
+func (app *Application) limit(w http.ResponseWriter, r *http.Request, key string, rule ratelimit.Rule) bool {
+	result, err := app.Limiter.Allow(r.Context(), key, rule)
+	if err != nil {
+		app.InternalSErrorResponse(w, r, err)
+		return false
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+		app.Metrics.RateLimited.Inc()
+		app.RateLimitExceedsResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// RateLimitIP counts every request per client IP. It has to run before
+// Authenticate, so that guessing bearer tokens is throttled like any other
+// request instead of getting a free token lookup each time.
+func (app *Application) RateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Config.Limiter.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			mu.Unlock()
+		rule := ratelimit.Rule{Rps: app.Config.Limiter.Rps, Burst: app.Config.Limiter.Burst}
+		if !app.limit(w, r, "ip:"+app.clientIP(r), rule) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimitUser adds a bucket per authenticated user, with the
+// -limiter-user-rps allowance, so one user cannot use up the allowance of
+// everybody else behind the same IP. It has to run after Authenticate.
+func (app *Application) RateLimitUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.ContextGetUser(r)
+		if !app.Config.Limiter.Enabled || user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule := ratelimit.Rule{Rps: app.Config.Limiter.UserRps, Burst: app.Config.Limiter.UserBurst}
+		if !app.limit(w, r, "user:"+strconv.FormatInt(user.ID, 10), rule) {
+			return
 		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// RouteRateLimit adds a bucket per client IP for the routes it wraps, on top
+// of the one RateLimitIP already took from, for endpoints such as
+// authentication that need a stricter limit than the rest of the API.
+func (app *Application) RouteRateLimit(name string, rule ratelimit.Rule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.Config.Limiter.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !app.limit(w, r, "route:"+name+":ip:"+app.clientIP(r), rule) {
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (app *Application) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -98,7 +281,7 @@ func (app *Application) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.Models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.Models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -133,18 +316,66 @@ func (app *Application) RequireActivatedUsr(next http.HandlerFunc) http.HandlerF
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requestIDPattern bounds what is accepted from a client supplied X-Request-ID
+// so the value is safe to echo into headers and logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID tags the request with the ID from the X-Request-ID header, when a
+// proxy in front already assigned one, or with a fresh random ID, and echoes
+// it back in the response.
+func (app *Application) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				app.InternalSErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, app.ContextSetRequestID(r, id))
+	})
+}
+
+// RouteLogger writes one access log entry per request once the handler is
+// done, when the status, size and duration of the response are known.
 func (app *Application) RouteLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
 
 		defer func() {
-			var message = "made a request at %v with the following configurations:"
+			status := sr.status
+			if status == 0 {
+				status = http.StatusOK
+			}
 
-			app.Logger.PrintInfo(fmt.Sprintf(message, r.URL.Path), map[string]string{
-				"method": r.Method,
-				"host":   r.Host,
+			route := ""
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				route = rctx.RoutePattern()
+			}
+
+			app.Logger.PrintInfo("request completed", map[string]string{
+				"request_id":  app.ContextGetRequestID(r),
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"route":       route,
+				"host":        r.Host,
+				"status":      strconv.Itoa(status),
+				"bytes":       strconv.Itoa(sr.bytes),
+				"duration_ms": strconv.FormatFloat(float64(time.Since(start).Microseconds())/1000, 'f', 3, 64),
+				"remote_ip":   app.clientIP(r),
+				"user_id":     app.contextGetUserID(r),
 			})
 		}()
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(sr, r)
 	})
 }
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// qualityValue is one element of an Accept or Accept-Encoding header.
+type qualityValue struct {
+	value string
+	q     float64
+}
+
+// parseQualityValues splits a header like "text/html;level=1, */*;q=0.5"
+// into its values and weights. Parameters other than q are dropped, and
+// elements with a malformed weight are skipped.
+func parseQualityValues(header string) []qualityValue {
+	var values []qualityValue
+
+	for _, element := range strings.Split(header, ",") {
+		params := strings.Split(element, ";")
+
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+
+		qv := qualityValue{value: value, q: 1}
+
+		for _, param := range params[1:] {
+			name, arg, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+			if err != nil || q < 0 || q > 1 {
+				qv.q = -1
+			} else {
+				qv.q = q
+			}
+		}
+
+		if qv.q >= 0 {
+			values = append(values, qv)
+		}
+	}
+
+	return values
+}
+
+// mediaTypeQuality returns the weight accept gives to mediaType, taken from
+// the most specific range matching it, and whether any range matched.
+func mediaTypeQuality(accept []qualityValue, mediaType string) (float64, bool) {
+	kind, _, _ := strings.Cut(mediaType, "/")
+
+	best, specificity := 0.0, -1
+
+	for _, qv := range accept {
+		var s int
+		switch qv.value {
+		case mediaType:
+			s = 2
+		case kind + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+
+		if s > specificity {
+			best, specificity = qv.q, s
+		}
+	}
+
+	return best, specificity >= 0
+}
+
+// negotiateMediaType picks the offer the Accept header prefers, ties going to
+// the earlier offer. It returns the first offer when there is no header and
+// an empty string when nothing offered is acceptable.
+func negotiateMediaType(header string, offers ...string) string {
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+
+	accept := parseQualityValues(header)
+
+	chosen, chosenQ := "", 0.0
+	for _, offer := range offers {
+		q, _ := mediaTypeQuality(accept, offer)
+		if q > chosenQ {
+			chosen, chosenQ = offer, q
+		}
+	}
+
+	return chosen
+}
+
+// Negotiate answers 406 Not Acceptable to requests whose Accept header rules
+// out every media type in offers, before the handler does any work. Asking
+// for application/problem+json counts as accepting JSON, since problem
+// details only describe errors and successes still need a format.
+func (app *Application) Negotiate(offers ...string) func(http.Handler) http.Handler {
+	acceptsJSON := slices.Contains(offers, "application/json")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+
+			if negotiateMediaType(r.Header.Get("Accept"), offers...) == "" && !(acceptsJSON && wantsProblem(r)) {
+				app.NotAcceptableResponse(w, r, offers)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// negotiateLanguage picks the offer the Accept-Language header prefers. A
+// range matches an offer equal to it or to its primary subtag, so "es-MX"
+// matches "es", and "*" matches anything. Ties go to the earlier offer, and
+// the first offer is the fallback when nothing matches.
+func negotiateLanguage(header string, offers ...string) string {
+	accept := parseQualityValues(header)
+
+	chosen, chosenQ := offers[0], 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+
+		for _, qv := range accept {
+			primary, _, _ := strings.Cut(qv.value, "-")
+
+			var s int
+			switch {
+			case qv.value == offer:
+				s = 2
+			case primary == offer:
+				s = 1
+			case qv.value == "*":
+				s = 0
+			default:
+				continue
+			}
+
+			if s > specificity {
+				q, specificity = qv.q, s
+			}
+		}
+
+		if q > chosenQ {
+			chosen, chosenQ = offer, q
+		}
+	}
+
+	return chosen
+}
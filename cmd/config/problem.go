@@ -0,0 +1,123 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
+)
+
+// problemMediaType is the media type of RFC 9457 problem details.
+const problemMediaType = "application/problem+json"
+
+// Problem is an RFC 9457 problem details object. Errors lists the fields that
+// failed validation, RequestID is the same extension member the default error
+// envelope carries.
+type Problem struct {
+	Type      string         `json:"type"`
+	Title     string         `json:"title"`
+	Status    int            `json:"status"`
+	Detail    string         `json:"detail,omitempty"`
+	Instance  string         `json:"instance,omitempty"`
+	Errors    []ProblemError `json:"errors,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+}
+
+// ProblemError is one entry of the errors member of a validation problem.
+// Code and Params identify the failure, Message renders them for people.
+type ProblemError struct {
+	Field   string           `json:"field"`
+	Message string           `json:"message"`
+	Code    string           `json:"code"`
+	Params  validator.Params `json:"params,omitempty"`
+}
+
+// wantsProblem reports whether the request names application/problem+json in
+// its Accept header. Wildcards do not count, so clients that never asked for
+// problem details keep getting the {"error": ...} envelope.
+func wantsProblem(r *http.Request) bool {
+	for _, qv := range parseQualityValues(r.Header.Get("Accept")) {
+		if qv.value == problemMediaType && qv.q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newProblem describes an error response as problem details. message is what
+// ErrorResponse would have put in the envelope: a string becomes the detail,
+// validation errors become the errors member.
+func (app *Application) newProblem(r *http.Request, status int, message interface{}) Problem {
+	problem := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Instance:  r.URL.Path,
+		RequestID: app.ContextGetRequestID(r),
+	}
+
+	if status == StatusClientClosedRequest {
+		problem.Title = "Client Closed Request"
+	}
+
+	switch message := message.(type) {
+	case string:
+		problem.Detail = message
+	case validationErrors:
+		problem.Detail = "the request contains invalid fields."
+		problem.Errors = problemErrors(message)
+	default:
+		problem.Detail = fmt.Sprint(message)
+	}
+
+	return problem
+}
+
+// problemErrors flattens validation errors into a list sorted by field, so
+// the same request always yields the same document. The failures of a field
+// keep the order they were found in.
+func problemErrors(ve validationErrors) []ProblemError {
+	var errors []ProblemError
+	for field, fieldErrors := range ve.errors {
+		for _, e := range fieldErrors {
+			errors = append(errors, ProblemError{
+				Field:   field,
+				Message: e.Message(ve.locale),
+				Code:    e.Code,
+				Params:  e.Params,
+			})
+		}
+	}
+
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errors[i].Field < errors[j].Field
+	})
+
+	return errors
+}
+
+// ProblemResponse sends problem as application/problem+json, indented under
+// the same rules as JsonWriter.
+func (app *Application) ProblemResponse(w http.ResponseWriter, r *http.Request, problem Problem) error {
+	var (
+		js  []byte
+		err error
+	)
+
+	if app.prettyJSON(r) {
+		js, err = json.MarshalIndent(problem, "", "\t")
+	} else {
+		js, err = json.Marshal(problem)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", problemMediaType)
+	w.WriteHeader(problem.Status)
+	w.Write(append(js, '\n'))
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
 )
@@ -38,10 +39,68 @@ func (app *Application) ReadInt(qs url.Values, key string, defaultvalue int, v *
 
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		v.AddError(key, "must be an integer value")
+		v.AddError(key, validator.CodeNotInteger, nil)
 		return defaultvalue
 	}
 
 	return i
 
 }
+
+func (app *Application) ReadBool(qs url.Values, key string, defaultvalue bool, v *validator.Validator) bool {
+
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultvalue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, validator.CodeNotBoolean, nil)
+		return defaultvalue
+	}
+
+	return b
+}
+
+// ReadOptionalInt is ReadInt for parameters without a sensible default, it
+// returns nil when the parameter is absent so callers can tell "no bound" apart
+// from zero.
+func (app *Application) ReadOptionalInt(qs url.Values, key string, v *validator.Validator) *int {
+
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, validator.CodeNotInteger, nil)
+		return nil
+	}
+
+	return &i
+}
+
+// ReadTime parses an RFC 3339 timestamp or a plain YYYY-MM-DD date (taken as
+// midnight UTC), returning nil when the parameter is absent.
+func (app *Application) ReadTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return &t
+		}
+	}
+
+	v.AddError(key, validator.CodeInvalidTime, nil)
+	return nil
+}
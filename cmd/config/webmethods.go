@@ -1,19 +1,70 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/3WDeveloper-GM/json-endpoints/internal/codec"
 	"github.com/go-chi/chi/v5"
 )
 
 type Envelope map[string]interface{}
 
+// Sparse narrows the JSON of Value down to the listed top-level keys. Value can
+// be an object or an array of objects, and an empty field list keeps
+// everything, so handlers can wrap resources unconditionally.
+type Sparse struct {
+	Value  interface{}
+	Fields []string
+}
+
+func (s Sparse) MarshalJSON() ([]byte, error) {
+	js, err := json.Marshal(s.Value)
+	if err != nil || len(s.Fields) == 0 {
+		return js, err
+	}
+
+	var list []map[string]json.RawMessage
+	if json.Unmarshal(js, &list) == nil {
+		for _, object := range list {
+			s.narrow(object)
+		}
+		return json.Marshal(list)
+	}
+
+	var object map[string]json.RawMessage
+	err = json.Unmarshal(js, &object)
+	if err != nil {
+		return nil, err
+	}
+
+	s.narrow(object)
+	return json.Marshal(object)
+}
+
+func (s Sparse) narrow(object map[string]json.RawMessage) {
+	for key := range object {
+		keep := false
+		for _, field := range s.Fields {
+			if key == field {
+				keep = true
+				break
+			}
+		}
+
+		if !keep {
+			delete(object, key)
+		}
+	}
+}
+
 func (app *Application) ReadIDparameter(w http.ResponseWriter, r *http.Request) (int64, error) {
 	parameter := chi.URLParamFromCtx(r.Context(), "id")
 
@@ -24,31 +75,144 @@ func (app *Application) ReadIDparameter(w http.ResponseWriter, r *http.Request)
 	return id, nil
 }
 
-func (app *Application) JsonWriter(w http.ResponseWriter, status int, data Envelope, headers http.Header) error {
-	js, err := json.MarshalIndent(data, "", "\t")
+// codecs are the encodings the API reads and writes, JSON first since it is
+// the default for requests without Accept or Content-Type.
+var codecs = []*codec.Codec{codec.JSON, codec.MessagePack, codec.CBOR}
+
+// CodecMediaTypes lists the media types of the codecs, for Negotiate.
+func CodecMediaTypes() []string {
+	mediaTypes := make([]string, len(codecs))
+	for i, c := range codecs {
+		mediaTypes[i] = c.MediaType
+	}
+	return mediaTypes
+}
+
+// responseCodec picks the codec the Accept header prefers, falling back to
+// JSON when it accepts none of them, as for the 406 response itself.
+func responseCodec(r *http.Request) *codec.Codec {
+	mediaType := negotiateMediaType(r.Header.Get("Accept"), CodecMediaTypes()...)
+
+	for _, c := range codecs {
+		if c.MediaType == mediaType {
+			return c
+		}
+	}
+	return codec.JSON
+}
+
+// requestCodec picks the codec named by the Content-Type header. Bodies of any
+// other type are read as JSON, as they always have been.
+func requestCodec(r *http.Request) *codec.Codec {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil {
+		for _, c := range codecs {
+			if c.MediaType == mediaType {
+				return c
+			}
+		}
+	}
+	return codec.JSON
+}
+
+// JsonWriter sends data in the encoding the Accept header prefers, JSON
+// unless it asks for MessagePack or CBOR. JSON is indented for people reading
+// it unless the API runs in production or the request asks for ?pretty=false.
+// ?pretty=true indents in production too.
+func (app *Application) JsonWriter(w http.ResponseWriter, r *http.Request, status int, data Envelope, headers http.Header) error {
+	c := responseCodec(r)
+
+	var (
+		js  []byte
+		err error
+	)
+
+	if c == codec.JSON && app.prettyJSON(r) {
+		js, err = json.MarshalIndent(data, "", "\t")
+	} else {
+		js, err = json.Marshal(data)
+	}
 	if err != nil {
 		app.ServerError(w, err)
 		return err
 	}
-	js = append(js, '\n')
+
+	if c == codec.JSON {
+		js = append(js, '\n')
+	} else {
+		js, err = c.FromJSON(js)
+		if err != nil {
+			app.ServerError(w, err)
+			return err
+		}
+	}
 
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", c.MediaType)
 	w.WriteHeader(status)
 	w.Write(js)
 
 	return nil
 }
 
+func (app *Application) prettyJSON(r *http.Request) bool {
+	pretty, err := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	if err != nil {
+		return app.Config.Mode != "production"
+	}
+	return pretty
+}
+
+// maxRequestBytes is the largest request body the API accepts.
+const maxRequestBytes = 1_048_576
+
+// JsonReader decodes the request body into dst. MessagePack and CBOR bodies,
+// flagged by their Content-Type, are converted to JSON first, so dst decodes
+// the same way and errors read the same whatever the encoding.
 func (app *Application) JsonReader(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 
-	maxBytes := 1_048_576
+	maxBytes := maxRequestBytes
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
-	dec := json.NewDecoder(r.Body)
+	c := requestCodec(r)
+
+	var body io.Reader = r.Body
+
+	if c != codec.JSON {
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				return fmt.Errorf("request body exceeds %d bytes, please make the request smaller", maxBytes)
+			}
+			return err
+		}
+
+		js, err := c.ToJSON(raw)
+		if err != nil {
+			var syntaxError *codec.SyntaxError
+			switch {
+			case errors.As(err, &syntaxError):
+				return fmt.Errorf("body contains badly-formed %s (at byte %d)", c.Name, syntaxError.Offset)
+			case errors.Is(err, io.ErrUnexpectedEOF):
+				return fmt.Errorf("body contains badly-formed %s", c.Name)
+			case errors.Is(err, io.EOF):
+				return errors.New("body must not be empty")
+			case errors.Is(err, codec.ErrTrailingData):
+				return fmt.Errorf("body must only contain a single %s value", c.Name)
+			case errors.Is(err, codec.ErrUnsupported):
+				return fmt.Errorf("body contains a %s value with no JSON equivalent", c.Name)
+			default:
+				return err
+			}
+		}
+
+		body = bytes.NewReader(js)
+	}
+
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
 	err := dec.Decode(dst)
@@ -59,12 +223,16 @@ func (app *Application) JsonReader(w http.ResponseWriter, r *http.Request, dst i
 		switch {
 		// errors corresponding to problems in the request.
 		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+			return fmt.Errorf("body contains badly-formed %s (at character %d)", c.Name, syntaxError.Offset)
 		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+			return fmt.Errorf("body contains badly-formed %s", c.Name)
 		case errors.As(err, &unmarshalTypeError):
 			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+				return fmt.Errorf("body contains incorrect %s type for field %q", c.Name, unmarshalTypeError.Field)
+			}
+			// Offsets into the converted JSON mean nothing to the client.
+			if c != codec.JSON {
+				return fmt.Errorf("body contains incorrect %s type", c.Name)
 			}
 			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
 		case errors.Is(err, io.EOF):
@@ -90,7 +258,7 @@ func (app *Application) JsonReader(w http.ResponseWriter, r *http.Request, dst i
 
 	err = dec.Decode(&struct{}{})
 	if err != io.EOF {
-		return errors.New("body must only contain a single JSON value")
+		return fmt.Errorf("body must only contain a single %s value", c.Name)
 	}
 
 	return nil
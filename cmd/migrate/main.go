@@ -0,0 +1,122 @@
+// Command migrate applies the embedded SQL migrations to a Postgres database.
+//
+//	migrate [-db-dsn dsn] up
+//	migrate [-db-dsn dsn] down [n]
+//	migrate [-db-dsn dsn] goto V
+//	migrate [-db-dsn dsn] force V
+//	migrate [-db-dsn dsn] status
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/migrate"
+	"github.com/3WDeveloper-GM/json-endpoints/migrations"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	dsn := flag.String("db-dsn", os.Getenv("TESTING_DSN"), "PostgreSQL DSN")
+	timeout := flag.Duration("timeout", 5*time.Minute, "maximum time to wait for the lock and run the migrations")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] up | down [n] | goto V | force V | status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	err := run(*dsn, *timeout, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dsn string, timeout time.Duration, args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var applied []*migrate.Migration
+
+	switch args[0] {
+	case "up":
+		applied, err = migrator.Up(ctx)
+	case "down":
+		steps := 0
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("down expects a positive number of steps, got %q", args[1])
+			}
+		}
+		applied, err = migrator.Down(ctx, steps)
+	case "goto", "force":
+		if len(args) < 2 {
+			return fmt.Errorf("%s expects a version", args[0])
+		}
+		version, perr := strconv.ParseInt(args[1], 10, 64)
+		if perr != nil || version < 0 {
+			return fmt.Errorf("%s expects a version, got %q", args[0], args[1])
+		}
+		if args[0] == "goto" {
+			applied, err = migrator.Goto(ctx, version)
+		} else {
+			err = migrator.Force(ctx, version)
+		}
+	case "status":
+		return printStatus(ctx, migrator)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	for _, migration := range applied {
+		fmt.Printf("%d_%s\n", migration.Version, migration.Name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return printStatus(ctx, migrator)
+}
+
+func printStatus(ctx context.Context, migrator *migrate.Migrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		state := "pending"
+		switch {
+		case status.Dirty:
+			state = "dirty"
+		case status.Applied:
+			state = "applied"
+		}
+		fmt.Printf("%-8s %d_%s\n", state, status.Version, status.Name)
+	}
+
+	return nil
+}
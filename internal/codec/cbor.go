@@ -0,0 +1,396 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// CBOR major types, the top three bits of the initial byte.
+const (
+	cborUint   = 0 << 5
+	cborNegint = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+
+	// cborIndefinite is the additional information of indefinite length
+	// strings, arrays and maps, which end at a cborBreak.
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+// cborHead writes the initial byte of major type major with argument n,
+// using the shortest form.
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		putUint(buf, n, 1)
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		putUint(buf, n, 2)
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		putUint(buf, n, 4)
+	default:
+		buf.WriteByte(major | 27)
+		putUint(buf, n, 8)
+	}
+}
+
+// cborWideNegint reports whether n is a negative integer below the int64 range
+// that CBOR still holds exactly, down to -2^64, and sets arg to its -1-n.
+// The decoder turns such integers into JSON, so they have to convert back.
+func cborWideNegint(n json.Number, arg *uint64) bool {
+	i, ok := new(big.Int).SetString(string(n), 10)
+	if !ok || i.Sign() >= 0 {
+		return false
+	}
+
+	// -1-n is at least 0 for negative n, it only has to fit in 64 bits.
+	i.Not(i)
+	if !i.IsUint64() {
+		return false
+	}
+
+	*arg = i.Uint64()
+	return true
+}
+
+func encodeCBOR(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		i, u, isInt, isUint := integer(v)
+		switch {
+		case isInt && i >= 0:
+			cborHead(buf, cborUint, uint64(i))
+		case isInt:
+			cborHead(buf, cborNegint, uint64(-1-i))
+		case isUint:
+			cborHead(buf, cborUint, u)
+		case cborWideNegint(v, &u):
+			cborHead(buf, cborNegint, u)
+		default:
+			f, err := v.Float64()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(0xfb)
+			putUint(buf, math.Float64bits(f), 8)
+		}
+	case string:
+		cborHead(buf, cborText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		cborHead(buf, cborArray, uint64(len(v)))
+		for _, elem := range v {
+			err := encodeCBOR(buf, elem)
+			if err != nil {
+				return err
+			}
+		}
+	case object:
+		cborHead(buf, cborMap, uint64(len(v)))
+		for _, m := range v {
+			encodeCBOR(buf, m.key)
+			err := encodeCBOR(buf, m.value)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("codec: cannot encode %T as CBOR", v)
+	}
+
+	return nil
+}
+
+// argument reads the argument that follows an initial byte with additional
+// information info.
+func (d *decoder) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		return d.uint(1 << (info - 24))
+	}
+
+	d.off--
+	return 0, d.errorf("invalid CBOR additional information %d", info)
+}
+
+func decodeCBOR(d *decoder) (interface{}, error) {
+	start := d.off
+
+	b, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	major, info := b&0xe0, b&0x1f
+
+	if major == cborSimple {
+		return cborSimpleValue(d, start, info)
+	}
+
+	if info == cborIndefinite {
+		switch major {
+		case cborBytes, cborText:
+			return cborChunks(d, major)
+		case cborArray:
+			return cborArrayOf(d, -1)
+		case cborMap:
+			return cborMapOf(d, -1)
+		}
+		d.off = start
+		return nil, d.errorf("indefinite length is not allowed for major type %d", major>>5)
+	}
+
+	n, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return json.Number(strconv.FormatUint(n, 10)), nil
+	case cborNegint:
+		if n <= math.MaxInt64 {
+			return json.Number(strconv.FormatInt(-1-int64(n), 10)), nil
+		}
+		neg := new(big.Int).SetUint64(n)
+		return json.Number(neg.Neg(neg.Add(neg, big.NewInt(1))).String()), nil
+	case cborBytes:
+		return d.bytes(n)
+	case cborText:
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case cborArray:
+		count, err := d.count(n)
+		if err != nil {
+			return nil, err
+		}
+		return cborArrayOf(d, count)
+	case cborMap:
+		count, err := d.count(n)
+		if err != nil {
+			return nil, err
+		}
+		return cborMapOf(d, count)
+	case cborTag:
+		// Tags only give meaning to the value that follows, such as a date
+		// to a string, so the value is kept and the tag dropped.
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+
+		return decodeCBOR(d)
+	}
+
+	d.off = start
+	return nil, d.errorf("invalid CBOR initial byte 0x%02x", b)
+}
+
+func cborSimpleValue(d *decoder, start int, info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		bits, err := d.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		return halfFloat(uint16(bits)), nil
+	case 26:
+		bits, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(bits))), nil
+	case 27:
+		bits, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case cborIndefinite:
+		d.off = start
+		return nil, d.errorf("unexpected break")
+	}
+
+	d.off = start
+	return nil, d.errorf("simple value %d is not supported", info)
+}
+
+// halfFloat widens an IEEE 754 half precision float.
+func halfFloat(bits uint16) float64 {
+	exp := int(bits>>10) & 0x1f
+	mant := float64(bits & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if bits&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+// atBreak consumes the break ending an indefinite length item, if it is next.
+func (d *decoder) atBreak() (bool, error) {
+	if d.off >= len(d.data) {
+		return false, io.ErrUnexpectedEOF
+	}
+	if d.data[d.off] == cborBreak {
+		d.off++
+		return true, nil
+	}
+	return false, nil
+}
+
+// cborChunks joins the definite length chunks of an indefinite length byte
+// or text string.
+func cborChunks(d *decoder, major byte) (interface{}, error) {
+	var joined []byte
+
+	for {
+		done, err := d.atBreak()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+
+		start := d.off
+		b, _ := d.byte()
+		if b&0xe0 != major || b&0x1f == cborIndefinite {
+			d.off = start
+			return nil, d.errorf("invalid chunk in indefinite length string")
+		}
+
+		n, err := d.argument(b & 0x1f)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		joined = append(joined, chunk...)
+	}
+
+	if major == cborText {
+		return string(joined), nil
+	}
+	return joined, nil
+}
+
+// cborArrayOf reads count elements, or up to a break when count is -1.
+func cborArrayOf(d *decoder, count int) (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	list := make([]interface{}, 0, max(count, 0))
+	for i := 0; count < 0 || i < count; i++ {
+		if count < 0 {
+			done, err := d.atBreak()
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				break
+			}
+		}
+
+		v, err := decodeCBOR(d)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+
+	return list, nil
+}
+
+// cborMapOf reads count pairs, or up to a break when count is -1.
+func cborMapOf(d *decoder, count int) (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	obj := make(object, 0, max(count, 0))
+	for i := 0; count < 0 || i < count; i++ {
+		if count < 0 {
+			done, err := d.atBreak()
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				break
+			}
+		}
+
+		keyOffset := d.off
+
+		key, err := decodeCBOR(d)
+		if err != nil {
+			return nil, err
+		}
+
+		s, ok := key.(string)
+		if !ok {
+			d.off = keyOffset
+			return nil, d.errorf("map keys must be strings")
+		}
+
+		v, err := decodeCBOR(d)
+		if err != nil {
+			return nil, err
+		}
+
+		obj = append(obj, member{key: s, value: v})
+	}
+
+	return obj, nil
+}
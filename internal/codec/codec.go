@@ -0,0 +1,306 @@
+// Package codec converts JSON documents to and from the binary encodings the
+// API offers next to JSON. Going through JSON keeps every MarshalJSON and
+// UnmarshalJSON method in charge of the representation, so a runtime is
+// "107 mins" in MessagePack and CBOR just as it is in JSON.
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+var (
+	// ErrTrailingData is returned for documents holding more than one value.
+	ErrTrailingData = errors.New("codec: data after the top-level value")
+	// ErrUnsupported is returned for values JSON cannot represent, like maps
+	// with integer keys or extension types.
+	ErrUnsupported = errors.New("codec: value has no JSON equivalent")
+)
+
+// SyntaxError reports malformed input at byte Offset.
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func (e *SyntaxError) Error() string { return e.msg }
+
+// maxDepth bounds the nesting of arrays and maps, which the decoders handle
+// recursively.
+const maxDepth = 1000
+
+// Codec is one encoding. Decoding empty input returns io.EOF and truncated
+// input io.ErrUnexpectedEOF, as encoding/json does.
+type Codec struct {
+	// Name is how error messages refer to the encoding.
+	Name      string
+	MediaType string
+
+	encode func(buf *bytes.Buffer, v interface{}) error
+	decode func(d *decoder) (interface{}, error)
+}
+
+var (
+	JSON        = &Codec{Name: "JSON", MediaType: "application/json"}
+	MessagePack = &Codec{Name: "MessagePack", MediaType: "application/msgpack", encode: encodeMsgpack, decode: decodeMsgpack}
+	CBOR        = &Codec{Name: "CBOR", MediaType: "application/cbor", encode: encodeCBOR, decode: decodeCBOR}
+)
+
+// FromJSON converts the JSON document js. Objects keep the order of their
+// members.
+func (c *Codec) FromJSON(js []byte) ([]byte, error) {
+	if c.encode == nil {
+		return js, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	v, err := parseJSON(dec, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = c.encode(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ToJSON converts b to a compact JSON document. Byte strings become base64
+// strings, like encoding/json writes []byte.
+func (c *Codec) ToJSON(b []byte) ([]byte, error) {
+	if c.decode == nil {
+		return b, nil
+	}
+
+	if len(b) == 0 {
+		return nil, io.EOF
+	}
+
+	d := &decoder{data: b}
+
+	v, err := c.decode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.off != len(d.data) {
+		return nil, ErrTrailingData
+	}
+
+	var buf bytes.Buffer
+	err = writeJSON(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// member and object keep JSON objects in order, which a map would lose.
+type member struct {
+	key   string
+	value interface{}
+}
+
+type object []member
+
+// parseJSON reads one value into nil, bool, json.Number, string,
+// []interface{} or object.
+func parseJSON(dec *json.Decoder, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("codec: nesting deeper than %d", maxDepth)
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			v, err := parseJSON(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+
+	case json.Delim('{'):
+		obj := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := parseJSON(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, member{key: key.(string), value: v})
+		}
+		_, err := dec.Token()
+		return obj, err
+	}
+
+	return tok, nil
+}
+
+// writeJSON writes the values the decoders produce: those of parseJSON plus
+// []byte and float64.
+func writeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		buf.WriteString(v.String())
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ErrUnsupported
+		}
+		js, _ := json.Marshal(v)
+		buf.Write(js)
+	case string:
+		js, _ := json.Marshal(v)
+		buf.Write(js)
+	case []byte:
+		buf.WriteByte('"')
+		buf.WriteString(base64.StdEncoding.EncodeToString(v))
+		buf.WriteByte('"')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeJSON(buf, elem)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case object:
+		buf.WriteByte('{')
+		for i, m := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			js, _ := json.Marshal(m.key)
+			buf.Write(js)
+			buf.WriteByte(':')
+			err := writeJSON(buf, m.value)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("codec: cannot write %T as JSON", v)
+	}
+
+	return nil
+}
+
+// integer classifies a JSON number for the binary encodings, which store
+// integers and floats differently. Integers too large for 64 bits are sent as
+// floats, losing precision just like a JavaScript client would. -0 stays a
+// float too, integers have no sign of their own to keep.
+func integer(n json.Number) (i int64, u uint64, isInt, isUint bool) {
+	if n == "-0" {
+		return 0, 0, false, false
+	}
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return i, 0, true, false
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return 0, u, false, true
+	}
+	return 0, 0, false, false
+}
+
+// decoder reads a binary document, checking every length against what is
+// left so hostile input cannot make it allocate more than it sent.
+type decoder struct {
+	data  []byte
+	off   int
+	depth int
+}
+
+func (d *decoder) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Offset: int64(d.off), msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.off >= len(d.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := d.data[d.off]
+	d.off++
+	return b, nil
+}
+
+func (d *decoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.off) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.data[d.off : d.off+int(n)]
+	d.off += int(n)
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.bytes(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// count validates a length prefix of elements that each take at least one
+// byte.
+func (d *decoder) count(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.off) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+func (d *decoder) enter() error {
+	d.depth++
+	if d.depth > maxDepth {
+		return d.errorf("nesting deeper than %d", maxDepth)
+	}
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+func putUint(buf *bytes.Buffer, n uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		buf.WriteByte(byte(n >> (8 * i)))
+	}
+}
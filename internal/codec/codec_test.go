@@ -0,0 +1,234 @@
+package codec
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func unhex(t testing.TB, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFromJSON(t *testing.T) {
+	tests := []struct {
+		codec *Codec
+		json  string
+		want  string
+	}{
+		{MessagePack, `null`, "c0"},
+		{MessagePack, `true`, "c3"},
+		{MessagePack, `1`, "01"},
+		{MessagePack, `-1`, "ff"},
+		{MessagePack, `200`, "cc c8"},
+		{MessagePack, `-200`, "d1 ff38"},
+		{MessagePack, `18446744073709551615`, "cf ffffffffffffffff"},
+		{MessagePack, `1.5`, "cb 3ff8000000000000"},
+		{MessagePack, `-0`, "cb 8000000000000000"},
+		{MessagePack, `"a"`, "a1 61"},
+		{MessagePack, `[1,2]`, "92 01 02"},
+		{MessagePack, `{"b":1,"a":[]}`, "82 a162 01 a161 90"},
+
+		{CBOR, `null`, "f6"},
+		{CBOR, `false`, "f4"},
+		{CBOR, `0`, "00"},
+		{CBOR, `100`, "18 64"},
+		{CBOR, `1000000`, "1a 000f4240"},
+		{CBOR, `-1`, "20"},
+		{CBOR, `-1000`, "39 03e7"},
+		{CBOR, `-18446744073709551616`, "3b ffffffffffffffff"},
+		{CBOR, `1.5`, "fb 3ff8000000000000"},
+		{CBOR, `"IETF"`, "64 49455446"},
+		{CBOR, `[1,[2,3]]`, "82 01 82 02 03"},
+		{CBOR, `{"b":1,"a":2}`, "a2 6162 01 6161 02"},
+
+		{JSON, `{"a":1}`, hex.EncodeToString([]byte(`{"a":1}`))},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.codec.FromJSON([]byte(tt.json))
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.codec.Name, tt.json, err)
+			continue
+		}
+
+		if want := unhex(t, tt.want); string(got) != string(want) {
+			t.Errorf("%s %s: got %x, want %x", tt.codec.Name, tt.json, got, want)
+		}
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		codec *Codec
+		input string
+		want  string
+	}{
+		{MessagePack, "c0", `null`},
+		{MessagePack, "e0", `-32`},
+		{MessagePack, "d0 80", `-128`},
+		{MessagePack, "ca 3fc00000", `1.5`},
+		{MessagePack, "d9 01 61", `"a"`},
+		{MessagePack, "c4 02 0102", `"AQI="`},
+		{MessagePack, "dc 0002 c2 c3", `[false,true]`},
+		{MessagePack, "81 a4 74797065 a1 78", `{"type":"x"}`},
+
+		{CBOR, "3b ffffffffffffffff", `-18446744073709551616`},
+		{CBOR, "f9 3e00", `1.5`},
+		{CBOR, "f9 c400", `-4`},
+		{CBOR, "f7", `null`},
+		{CBOR, "c1 1a 514b67b0", `1363896240`},
+		{CBOR, "7f 65 7374726561 64 6d696e67 ff", `"streaming"`},
+		{CBOR, "9f 01 82 02 03 ff", `[1,[2,3]]`},
+		{CBOR, "bf 61 61 01 ff", `{"a":1}`},
+		{CBOR, "43 010203", `"AQID"`},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.codec.ToJSON(unhex(t, tt.input))
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.codec.Name, tt.input, err)
+			continue
+		}
+
+		if string(got) != tt.want {
+			t.Errorf("%s %s: got %s, want %s", tt.codec.Name, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	doc := `{"movie":{"id":1,"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation","adventure"],"rating":-7.25,"seen":false,"notes":null}}`
+
+	for _, c := range []*Codec{MessagePack, CBOR} {
+		encoded, err := c.FromJSON([]byte(doc))
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name, err)
+		}
+
+		got, err := c.ToJSON(encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name, err)
+		}
+
+		if string(got) != doc {
+			t.Errorf("%s: got %s, want %s", c.Name, got, doc)
+		}
+	}
+}
+
+func TestToJSONErrors(t *testing.T) {
+	tests := []struct {
+		codec  *Codec
+		input  string
+		want   error
+		syntax bool
+	}{
+		{MessagePack, "", io.EOF, false},
+		{MessagePack, "a5 6162", io.ErrUnexpectedEOF, false},
+		{MessagePack, "dd ffffffff", io.ErrUnexpectedEOF, false},
+		{MessagePack, "01 02", ErrTrailingData, false},
+		{MessagePack, "81 01 01", nil, true},
+		{MessagePack, "d4 01 00", nil, true},
+		{MessagePack, "c1", nil, true},
+
+		{CBOR, "", io.EOF, false},
+		{CBOR, "9f 01", io.ErrUnexpectedEOF, false},
+		{CBOR, "9b ffffffffffffffff", io.ErrUnexpectedEOF, false},
+		{CBOR, "f6 f6", ErrTrailingData, false},
+		{CBOR, "a1 01 01", nil, true},
+		{CBOR, "ff", nil, true},
+		{CBOR, "1c", nil, true},
+		{CBOR, "f8 20", nil, true},
+		{CBOR, "7f 01 ff", nil, true},
+		{CBOR, strings.Repeat("81", 2000) + "00", nil, true},
+	}
+
+	for _, tt := range tests {
+		_, err := tt.codec.ToJSON(unhex(t, tt.input))
+
+		var syntaxError *SyntaxError
+		switch {
+		case tt.syntax && !errors.As(err, &syntaxError):
+			t.Errorf("%s %.20s: got %v, want a syntax error", tt.codec.Name, tt.input, err)
+		case !tt.syntax && !errors.Is(err, tt.want):
+			t.Errorf("%s %.20s: got %v, want %v", tt.codec.Name, tt.input, err, tt.want)
+		}
+	}
+}
+
+// FuzzToJSON feeds arbitrary input to the decoders, which read request bodies
+// straight off the network. They must never panic, and whatever they accept
+// has to come out as valid JSON that converts back to the same document.
+func FuzzToJSON(f *testing.F) {
+	seeds := []struct {
+		cbor  bool
+		input string
+	}{
+		{false, "c0"},
+		{false, "d0 80"},
+		{false, "ca 3fc00000"},
+		{false, "c4 02 0102"},
+		{false, "dc 0002 c2 c3"},
+		{false, "81 a4 74797065 a1 78"},
+		{false, "a5 6162"},
+		{false, "81 01 01"},
+		{false, "d4 01 00"},
+		{false, "cf ffffffffffffffff"},
+
+		{true, "3b ffffffffffffffff"},
+		{true, "f9 3e00"},
+		{true, "c1 1a 514b67b0"},
+		{true, "7f 65 7374726561 64 6d696e67 ff"},
+		{true, "9f 01 82 02 03 ff"},
+		{true, "bf 61 61 01 ff"},
+		{true, "43 010203"},
+		{true, "9b ffffffffffffffff"},
+		{true, "7f 01 ff"},
+		{true, "f8 20"},
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed.cbor, unhex(f, seed.input))
+	}
+
+	f.Fuzz(func(t *testing.T, cbor bool, input []byte) {
+		c := MessagePack
+		if cbor {
+			c = CBOR
+		}
+
+		js, err := c.ToJSON(input)
+		if err != nil {
+			return
+		}
+
+		if !json.Valid(js) {
+			t.Fatalf("%s %x: invalid JSON %s", c.Name, input, js)
+		}
+
+		// Not every document converts back, MessagePack has no integers
+		// below -2^63, but those that do must decode to the same JSON.
+		encoded, err := c.FromJSON(js)
+		if err != nil {
+			return
+		}
+
+		again, err := c.ToJSON(encoded)
+		if err != nil {
+			t.Fatalf("%s %x: re-encoded %s does not decode: %v", c.Name, input, js, err)
+		}
+		if string(again) != string(js) {
+			t.Fatalf("%s %x: got %s after a round trip, want %s", c.Name, input, again, js)
+		}
+	})
+}
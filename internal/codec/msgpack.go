@@ -0,0 +1,288 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		i, u, isInt, isUint := integer(v)
+		switch {
+		case isInt:
+			msgpackInt(buf, i)
+		case isUint:
+			buf.WriteByte(0xcf)
+			putUint(buf, u, 8)
+		default:
+			f, err := v.Float64()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(0xcb)
+			putUint(buf, math.Float64bits(f), 8)
+		}
+	case string:
+		n := uint64(len(v))
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			putUint(buf, n, 1)
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			putUint(buf, n, 2)
+		default:
+			buf.WriteByte(0xdb)
+			putUint(buf, n, 4)
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		msgpackHeader(buf, uint64(len(v)), 0x90, 0xdc)
+		for _, elem := range v {
+			err := encodeMsgpack(buf, elem)
+			if err != nil {
+				return err
+			}
+		}
+	case object:
+		msgpackHeader(buf, uint64(len(v)), 0x80, 0xde)
+		for _, m := range v {
+			encodeMsgpack(buf, m.key)
+			err := encodeMsgpack(buf, m.value)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("codec: cannot encode %T as MessagePack", v)
+	}
+
+	return nil
+}
+
+// msgpackInt writes i in the smallest of the integer formats.
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i >= -32 && i < 0:
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		putUint(buf, uint64(i), 1)
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		putUint(buf, uint64(i), 2)
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		putUint(buf, uint64(i), 4)
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		putUint(buf, uint64(i), 8)
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		putUint(buf, uint64(i), 1)
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		putUint(buf, uint64(i), 2)
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		putUint(buf, uint64(i), 4)
+	default:
+		buf.WriteByte(0xd3)
+		putUint(buf, uint64(i), 8)
+	}
+}
+
+// msgpackHeader writes the length of an array or map, fix being the fixarray
+// or fixmap prefix and wide the 16 bit format, followed by the 32 bit one.
+func msgpackHeader(buf *bytes.Buffer, n uint64, fix, wide byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(wide)
+		putUint(buf, n, 2)
+	default:
+		buf.WriteByte(wide + 1)
+		putUint(buf, n, 4)
+	}
+}
+
+func decodeMsgpack(d *decoder) (interface{}, error) {
+	start := d.off
+
+	b, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return json.Number(strconv.Itoa(int(b))), nil
+	case b >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(b)))), nil
+	case b&0xf0 == 0x80:
+		return msgpackMap(d, uint64(b&0x0f))
+	case b&0xf0 == 0x90:
+		return msgpackArray(d, uint64(b&0x0f))
+	case b&0xe0 == 0xa0:
+		return msgpackString(d, uint64(b&0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.bytes(n)
+
+	case 0xca:
+		bits, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(bits))), nil
+	case 0xcb:
+		bits, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatUint(n, 10)), nil
+
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend from size bytes.
+		shift := 64 - 8*size
+		return json.Number(strconv.FormatInt(int64(n<<shift)>>shift, 10)), nil
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackString(d, n)
+
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackArray(d, n)
+
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackMap(d, n)
+
+	case 0xc7, 0xc8, 0xc9, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		d.off = start
+		return nil, d.errorf("extension types are not supported")
+	}
+
+	d.off = start
+	return nil, d.errorf("invalid MessagePack format 0x%02x", b)
+}
+
+func msgpackString(d *decoder, n uint64) (interface{}, error) {
+	b, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func msgpackArray(d *decoder, n uint64) (interface{}, error) {
+	count, err := d.count(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	list := make([]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		v, err := decodeMsgpack(d)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+
+	return list, nil
+}
+
+func msgpackMap(d *decoder, n uint64) (interface{}, error) {
+	count, err := d.count(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	obj := make(object, 0, count)
+	for i := 0; i < count; i++ {
+		keyOffset := d.off
+
+		key, err := decodeMsgpack(d)
+		if err != nil {
+			return nil, err
+		}
+
+		s, ok := key.(string)
+		if !ok {
+			d.off = keyOffset
+			return nil, d.errorf("map keys must be strings")
+		}
+
+		v, err := decodeMsgpack(d)
+		if err != nil {
+			return nil, err
+		}
+
+		obj = append(obj, member{key: s, value: v})
+	}
+
+	return obj, nil
+}
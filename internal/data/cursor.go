@@ -0,0 +1,85 @@
+package data
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a keyset-paginated listing: the sort it was issued
+// for, the value of every sort column (id last) of the row at the edge of the
+// page, and whether it points at the rows before (prev) or after (next) it.
+type Cursor struct {
+	Sort   string        `json:"s"`
+	Keys   []interface{} `json:"k"`
+	Before bool          `json:"b,omitempty"`
+}
+
+// EncodeCursor serializes the cursor and signs it with secret, clients get an
+// opaque string they can hand back but not forge.
+func EncodeCursor(c Cursor, secret []byte) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// DecodeCursor verifies the signature of an encoded cursor and returns its
+// contents. Any tampering or malformed input yields ErrInvalidCursor.
+func DecodeCursor(s string, secret []byte) (Cursor, error) {
+	var c Cursor
+
+	payloadPart, signaturePart, found := strings.Cut(s, ".")
+	if !found {
+		return c, ErrInvalidCursor
+	}
+
+	enc := base64.RawURLEncoding
+
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	signature, err := enc.DecodeString(signaturePart)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return c, ErrInvalidCursor
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	err = dec.Decode(&c)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	for i, key := range c.Keys {
+		if number, ok := key.(json.Number); ok {
+			c.Keys[i], err = number.Int64()
+			if err != nil {
+				return c, ErrInvalidCursor
+			}
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,194 @@
+package data
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
+)
+
+var testCursorSecret = []byte("test-cursor-secret")
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursor := Cursor{Sort: "-year,title", Keys: []interface{}{int64(1995), "Heat", int64(7)}, Before: true}
+
+	encoded, err := EncodeCursor(cursor, testCursorSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeCursor(encoded, testCursorSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, cursor) {
+		t.Errorf("got %#v, want %#v", decoded, cursor)
+	}
+}
+
+func TestCursorTampering(t *testing.T) {
+	encoded, err := EncodeCursor(Cursor{Sort: "id", Keys: []interface{}{int64(42)}}, testCursorSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(encoded, ".")
+
+	forged, err := EncodeCursor(Cursor{Sort: "id", Keys: []interface{}{int64(1)}}, testCursorSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name    string
+		encoded string
+		secret  []byte
+	}{
+		{"other secret", encoded, []byte("another-secret")},
+		{"swapped payload", forgedPayload + "." + signature, testCursorSecret},
+		{"truncated signature", payload + "." + signature[:len(signature)-2], testCursorSecret},
+		{"no signature", payload, testCursorSecret},
+		{"not base64", "!!!." + signature, testCursorSecret},
+		{"empty", "", testCursorSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeCursor(tt.encoded, tt.secret)
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestValidateFiltersCursor(t *testing.T) {
+	filters := func(sort []string, cursor string) Filters {
+		return Filters{
+			Page:         1,
+			PageSize:     20,
+			Sort:         sort,
+			SortSafeList: []string{"id", "title", "year", "-id", "-title", "-year"},
+			Cursor:       cursor,
+			CursorSecret: testCursorSecret,
+		}
+	}
+
+	issued := filters([]string{"-year"}, "")
+	cursor, err := issued.newCursor(func(column string) interface{} {
+		return map[string]interface{}{"year": int64(1995), "id": int64(3)}[column]
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A cursor signed for a sort with another number of keys.
+	short, err := EncodeCursor(Cursor{Sort: "-year", Keys: []interface{}{int64(1995)}}, testCursorSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		filters Filters
+		code    string
+	}{
+		{"valid", filters([]string{"-year"}, cursor), ""},
+		{"other sort", filters([]string{"title"}, cursor), validator.CodeCursorMismatch},
+		{"wrong key count", filters([]string{"-year"}, short), validator.CodeInvalidCursor},
+		{"tampered", filters([]string{"-year"}, cursor+"x"), validator.CodeInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.NewValidator()
+			ValidateFilters(v, tt.filters)
+
+			var codes []string
+			for _, e := range v.Errors["cursor"] {
+				codes = append(codes, e.Code)
+			}
+
+			if got := strings.Join(codes, ","); got != tt.code {
+				t.Errorf("got cursor errors %q, want %q", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	safelist := []string{"id", "title", "year", "-id", "-title", "-year"}
+
+	tests := []struct {
+		name   string
+		sort   []string
+		cursor Cursor
+		want   string
+		args   []interface{}
+	}{
+		{
+			name:   "id only",
+			sort:   []string{"id"},
+			cursor: Cursor{Keys: []interface{}{int64(7)}},
+			want:   "((id > $1))",
+			args:   []interface{}{int64(7)},
+		},
+		{
+			name:   "descending with tiebreak",
+			sort:   []string{"-year"},
+			cursor: Cursor{Keys: []interface{}{int64(1995), int64(7)}},
+			want:   "((year < $1) OR (year = $1 AND id > $2))",
+			args:   []interface{}{int64(1995), int64(7)},
+		},
+		{
+			name:   "mixed directions",
+			sort:   []string{"title", "-year"},
+			cursor: Cursor{Keys: []interface{}{"Heat", int64(1995), int64(7)}},
+			want:   "((title > $1) OR (title = $1 AND year < $2) OR (title = $1 AND year = $2 AND id > $3))",
+			args:   []interface{}{"Heat", int64(1995), int64(7)},
+		},
+		{
+			name:   "prev cursor reverses",
+			sort:   []string{"-year"},
+			cursor: Cursor{Keys: []interface{}{int64(1995), int64(7)}, Before: true},
+			want:   "((year > $1) OR (year = $1 AND id < $2))",
+			args:   []interface{}{int64(1995), int64(7)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Filters{Sort: tt.sort, SortSafeList: safelist}
+
+			args := queryArgs{}
+			got := f.keysetCondition(tt.cursor, &args)
+
+			if got != tt.want {
+				t.Errorf("got %s\nwant %s", got, tt.want)
+			}
+			if !reflect.DeepEqual([]interface{}(args), tt.args) {
+				t.Errorf("got args %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestKeysetConditionAfterFilters(t *testing.T) {
+	f := Filters{Sort: []string{"year"}, SortSafeList: []string{"year"}}
+
+	year := 1990
+	args := queryArgs{}
+	conditions := MovieFilter{YearMin: &year}.conditions(&args)
+	conditions = append(conditions, f.keysetCondition(Cursor{Keys: []interface{}{int64(1995), int64(7)}}, &args))
+
+	want := "WHERE year >= $1\n\t\tAND ((year > $2) OR (year = $2 AND id > $3))"
+	if got := whereClause(conditions); got != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+	if len(args) != 3 {
+		t.Errorf("got %d args, want 3", len(args))
+	}
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"fmt"
 	"math"
+	"strconv"
 	"strings"
 
 	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
@@ -11,16 +12,22 @@ import (
 type Filters struct {
 	Page         int
 	PageSize     int
-	Sort         string
+	Sort         []string
 	SortSafeList []string
+	Cursor       string
+	CursorSecret []byte
+	IncludeTotal bool
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
+	Fuzzy        bool   `json:"fuzzy,omitempty"`
 }
 
 func CalculateMetadata(totalrecords, page, pagesize int) Metadata {
@@ -37,35 +44,101 @@ func CalculateMetadata(totalrecords, page, pagesize int) Metadata {
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
-	minimumPageQuantity, maximumPageQUantity := 0, 10_000_000
+	minimumPageQuantity, maximumPageQUantity := 1, 9_999_999
+	v.Check(f.Page >= minimumPageQuantity && f.Page <= maximumPageQUantity, "page", validator.CodeOutOfRange, validator.Params{"min": minimumPageQuantity, "max": maximumPageQUantity})
 
-	var moreThanMsg = "must be greater than"
-	var lessthanMsg = "must be less than"
-	v.Check(f.Page > minimumPageQuantity, "page", fmt.Sprintf(moreThanMsg+" %v", minimumPageQuantity))
-	v.Check(f.Page < maximumPageQUantity, "page", fmt.Sprintf(lessthanMsg+" %v", maximumPageQUantity))
+	minimumPageSize, maximumPageSize := 1, 99
+	v.Check(f.PageSize >= minimumPageSize && f.PageSize <= maximumPageSize, "page_size", validator.CodeOutOfRange, validator.Params{"min": minimumPageSize, "max": maximumPageSize})
 
-	minimumPageSize, maximumPageSize := 0, 100
-	v.Check(f.PageSize > minimumPageSize, "page_size", fmt.Sprintf(moreThanMsg+" %v", minimumPageSize))
-	v.Check(f.PageSize < maximumPageSize, "page_size", fmt.Sprintf(lessthanMsg+" %v", maximumPageSize))
+	v.Check(len(f.Sort) > 0, "sort", validator.CodeRequired, nil)
 
-	var sortMsg = "invalid sort value"
-	v.Check(validator.In(f.Sort, f.SortSafeList...), "sort", sortMsg)
+	sortValid := len(f.Sort) > 0
+
+	seen := make(map[string]bool)
+	for _, sort := range f.Sort {
+		if !validator.In(sort, f.SortSafeList...) {
+			v.AddError("sort", validator.CodeNotAllowed, validator.Params{"value": sort, "allowed": f.SortSafeList})
+			sortValid = false
+			continue
+		}
+
+		column := strings.TrimPrefix(sort, "-")
+		v.Check(!seen[column], "sort", validator.CodeNotUnique, validator.Params{"value": column})
+		seen[column] = true
+	}
+
+	// Decoding the cursor needs a usable sort to know how many keys to expect.
+	if f.Cursor != "" && sortValid {
+		cursor, err := f.decodedCursor()
+		if err != nil {
+			v.AddError("cursor", validator.CodeInvalidCursor, nil)
+			return
+		}
+
+		v.Check(cursor.Sort == strings.Join(f.Sort, ","), "cursor", validator.CodeCursorMismatch, nil)
+	}
 }
 
-func (f Filters) SortColumn() string {
-	for _, safevalue := range f.SortSafeList {
-		if f.Sort == safevalue {
-			return strings.TrimPrefix(f.Sort, "-")
+// sortTerm is one column of an ORDER BY list.
+type sortTerm struct {
+	Column     string
+	Descending bool
+}
+
+// sortTerms turns the validated sort list into ORDER BY terms, appending id as
+// the final tiebreaker so that every ordering is total and stable between
+// pages. Nothing after an explicit id could ever break a tie, so the list stops
+// there.
+func (f Filters) sortTerms() []sortTerm {
+	terms := []sortTerm{}
+
+	for _, sort := range f.Sort {
+		if !validator.In(sort, f.SortSafeList...) {
+			panic("unsafe sort parameter: " + sort)
+		}
+
+		term := sortTerm{Column: strings.TrimPrefix(sort, "-"), Descending: strings.HasPrefix(sort, "-")}
+		terms = append(terms, term)
+
+		if term.Column == "id" {
+			return terms
 		}
 	}
-	panic("unsafe sort parameter: " + f.Sort)
+
+	return append(terms, sortTerm{Column: "id"})
 }
 
-func (f Filters) SortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+// sortColumns returns the columns the ordering depends on, which a query has
+// to select for cursors to be built from its rows.
+func (f Filters) sortColumns() []string {
+	columns := []string{}
+	for _, term := range f.sortTerms() {
+		columns = append(columns, term.Column)
 	}
-	return "ASC"
+	return columns
+}
+
+// OrderBy builds the ORDER BY list for the sort, without the keyword itself.
+// Every column has been checked against the safelist so it can be interpolated
+// into the statement.
+func (f Filters) OrderBy() string {
+	return f.orderBy(false)
+}
+
+// orderBy optionally reverses every direction, which is how a prev cursor walks
+// backwards with the rows nearest the cursor coming first.
+func (f Filters) orderBy(reverse bool) string {
+	clauses := []string{}
+
+	for _, term := range f.sortTerms() {
+		direction := "ASC"
+		if term.Descending != reverse {
+			direction = "DESC"
+		}
+		clauses = append(clauses, term.Column+" "+direction)
+	}
+
+	return strings.Join(clauses, ", ")
 }
 
 func (f Filters) Limit() int {
@@ -73,5 +146,96 @@ func (f Filters) Limit() int {
 }
 
 func (f Filters) Offset() int {
+	if f.Cursor != "" {
+		return 0
+	}
 	return (f.Page - 1) * f.PageSize
 }
+
+// decodedCursor returns the keyset position carried by f.Cursor, checking that
+// it was signed with f.CursorSecret.
+func (f Filters) decodedCursor() (Cursor, error) {
+	cursor, err := DecodeCursor(f.Cursor, f.CursorSecret)
+	if err != nil {
+		return cursor, err
+	}
+
+	if len(cursor.Keys) != len(f.sortTerms()) {
+		return cursor, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+// newCursor builds the signed cursor pointing before or after a row. key
+// returns the row's value for a sort column.
+func (f Filters) newCursor(key func(column string) interface{}, before bool) (string, error) {
+	cursor := Cursor{Sort: strings.Join(f.Sort, ","), Before: before}
+
+	for _, term := range f.sortTerms() {
+		cursor.Keys = append(cursor.Keys, key(term.Column))
+	}
+
+	return EncodeCursor(cursor, f.CursorSecret)
+}
+
+// keysetCondition returns the WHERE fragment that selects the rows after (or,
+// for a prev cursor, before) the cursor position, binding the cursor values
+// into args. With mixed directions a row comparison can't be used, so it is
+// spelled out as (a > x) OR (a = x AND b < y) OR ...
+func (f Filters) keysetCondition(cursor Cursor, args *queryArgs) string {
+	terms := f.sortTerms()
+	params := make([]string, len(terms))
+
+	for i := range terms {
+		params[i] = args.add(cursor.Keys[i])
+	}
+
+	alternatives := []string{}
+
+	for i, term := range terms {
+		parts := []string{}
+
+		for j := 0; j < i; j++ {
+			parts = append(parts, fmt.Sprintf("%s = %s", terms[j].Column, params[j]))
+		}
+
+		op := ">"
+		if term.Descending != cursor.Before {
+			op = "<"
+		}
+		parts = append(parts, fmt.Sprintf("%s %s %s", term.Column, op, params[i]))
+
+		alternatives = append(alternatives, "("+strings.Join(parts, " AND ")+")")
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+
+// queryArgs collects positional query arguments while a statement is being
+// assembled, handing back the placeholder for each one.
+type queryArgs []interface{}
+
+func (a *queryArgs) add(value interface{}) string {
+	*a = append(*a, value)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// whereClause joins conditions into a WHERE clause, or nothing when there are
+// no conditions at all.
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conditions, "\n\t\tAND ")
+}
+
+// ValidateFields checks a sparse fieldset against the allowlist of the resource
+// it applies to.
+func ValidateFields(v *validator.Validator, fields []string, safelist []string) {
+	for _, field := range fields {
+		v.Check(validator.In(field, safelist...), "fields", validator.CodeNotAllowed, validator.Params{"value": field, "allowed": safelist})
+	}
+
+	v.Check(validator.Unique(fields), "fields", validator.CodeNotUnique, nil)
+}
@@ -0,0 +1,69 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrderBy(t *testing.T) {
+	safelist := []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
+	tests := []struct {
+		name     string
+		sort     []string
+		want     string
+		reversed string
+		columns  string
+	}{
+		{"id", []string{"id"}, "id ASC", "id DESC", "id"},
+		{"tiebreak appended", []string{"-year"}, "year DESC, id ASC", "year ASC, id DESC", "year,id"},
+		{"several columns", []string{"-runtime", "title"}, "runtime DESC, title ASC, id ASC", "runtime ASC, title DESC, id DESC", "runtime,title,id"},
+		{"stops at id", []string{"year", "-id", "title"}, "year ASC, id DESC", "year DESC, id ASC", "year,id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Filters{Sort: tt.sort, SortSafeList: safelist}
+
+			if got := f.OrderBy(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if got := f.orderBy(true); got != tt.reversed {
+				t.Errorf("reversed: got %q, want %q", got, tt.reversed)
+			}
+			if got := strings.Join(f.sortColumns(), ","); got != tt.columns {
+				t.Errorf("got columns %q, want %q", got, tt.columns)
+			}
+		})
+	}
+}
+
+func TestOrderByUnsafe(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("an unsafe sort column did not panic")
+		}
+	}()
+
+	Filters{Sort: []string{"title; DROP TABLE movies"}, SortSafeList: []string{"title"}}.OrderBy()
+}
+
+func TestLimitOffset(t *testing.T) {
+	tests := []struct {
+		filters Filters
+		offset  int
+	}{
+		{Filters{Page: 1, PageSize: 20}, 0},
+		{Filters{Page: 3, PageSize: 20}, 40},
+		{Filters{Page: 3, PageSize: 20, Cursor: "ignored"}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := tt.filters.Offset(); got != tt.offset {
+			t.Errorf("%+v: got offset %d, want %d", tt.filters, got, tt.offset)
+		}
+		if got := tt.filters.Limit(); got != tt.filters.PageSize {
+			t.Errorf("%+v: got limit %d, want %d", tt.filters, got, tt.filters.PageSize)
+		}
+	}
+}
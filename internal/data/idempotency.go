@@ -0,0 +1,194 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
+)
+
+var (
+	ErrIdempotencyInFlight = errors.New("idempotency key in use by a request in flight")
+	ErrIdempotencyMismatch = errors.New("idempotency key reused for a different request")
+	ErrIdempotencyLost     = errors.New("idempotency key claim expired before the response was stored")
+)
+
+// StoredResponse is the response captured for an idempotency key, replayed
+// to every retry of the request that produced it.
+type StoredResponse struct {
+	Status int
+	Header map[string][]string
+	Body   []byte
+}
+
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(key != "", "idempotency_key", validator.CodeRequired, nil)
+	v.Check(len(key) <= 255, "idempotency_key", validator.CodeTooLong, validator.Params{"max": 255})
+
+	for _, c := range []byte(key) {
+		if c < 0x21 || c > 0x7e {
+			v.AddError("idempotency_key", validator.CodeInvalidCharacters, nil)
+			break
+		}
+	}
+}
+
+// Begin claims key for the request hashed as requestHash, until lockTTL passes
+// or Complete stores its response. It returns nil when the claim succeeded,
+// the stored response when the request was already served, and
+// ErrIdempotencyInFlight or ErrIdempotencyMismatch otherwise. Keys whose
+// expiry has passed are claimed as if they had never been used.
+//
+// Complete stores the response and keeps it until ttl passes. Release drops
+// a claim whose request failed, so a retry can run it again. Both only touch
+// the claim Begin made for requestHash, a request that outlived lockTTL gets
+// ErrIdempotencyLost from Complete rather than overwriting the next claim.
+type IdempotencyRepository interface {
+	Begin(ctx context.Context, userID int64, key string, requestHash []byte, lockTTL time.Duration) (*StoredResponse, error)
+	Complete(ctx context.Context, userID int64, key string, requestHash []byte, response *StoredResponse, ttl time.Duration) error
+	Release(ctx context.Context, userID int64, key string, requestHash []byte) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type IdempotencyModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+func (m IdempotencyModel) Begin(ctx context.Context, userID int64, key string, requestHash []byte, lockTTL time.Duration) (_ *StoredResponse, err error) {
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, request_hash, expiry)
+		VALUES ($1, $2, $3, now() + make_interval(secs => $4::float8))
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = NULL, header = NULL, body = NULL, expiry = EXCLUDED.expiry
+		WHERE idempotency_keys.expiry <= now()
+	`
+
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "IdempotencyModel.Begin")
+	defer finish(&err)
+
+	res, err := m.DB.ExecContext(ctx, query, userID, key, requestHash, lockTTL.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if claimed == 1 {
+		return nil, nil
+	}
+
+	query = `
+		SELECT request_hash, status, header, body
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2
+	`
+
+	var (
+		storedHash []byte
+		status     sql.NullInt32
+		header     []byte
+		body       []byte
+	)
+
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(&storedHash, &status, &header, &body)
+	if err != nil {
+		// The claim holding the key was released in the meantime.
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrIdempotencyInFlight
+		}
+		return nil, err
+	}
+
+	return storedResult(requestHash, storedHash, status, header, body)
+}
+
+func storedResult(requestHash, storedHash []byte, status sql.NullInt32, header, body []byte) (*StoredResponse, error) {
+	if !bytes.Equal(requestHash, storedHash) {
+		return nil, ErrIdempotencyMismatch
+	}
+
+	if !status.Valid {
+		return nil, ErrIdempotencyInFlight
+	}
+
+	response := &StoredResponse{Status: int(status.Int32), Body: body}
+
+	err := json.Unmarshal(header, &response.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (m IdempotencyModel) Complete(ctx context.Context, userID int64, key string, requestHash []byte, response *StoredResponse, ttl time.Duration) (err error) {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+
+	// The claim may have expired and been taken by another request, whose
+	// hash or status then differs.
+	query := `
+		UPDATE idempotency_keys
+		SET status = $4, header = $5, body = $6, expiry = now() + make_interval(secs => $7::float8)
+		WHERE user_id = $1 AND key = $2 AND request_hash = $3 AND status IS NULL
+	`
+
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "IdempotencyModel.Complete")
+	defer finish(&err)
+
+	res, err := m.DB.ExecContext(ctx, query, userID, key, requestHash, response.Status, header, response.Body, ttl.Seconds())
+	if err != nil {
+		return err
+	}
+
+	stored, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if stored == 0 {
+		return ErrIdempotencyLost
+	}
+
+	return nil
+}
+
+func (m IdempotencyModel) Release(ctx context.Context, userID int64, key string, requestHash []byte) (err error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND request_hash = $3 AND status IS NULL
+	`
+
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "IdempotencyModel.Release")
+	defer finish(&err)
+
+	_, err = m.DB.ExecContext(ctx, query, userID, key, requestHash)
+	return err
+}
+
+func (m IdempotencyModel) DeleteExpired(ctx context.Context) (_ int64, err error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expiry <= now()
+	`
+
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "IdempotencyModel.DeleteExpired")
+	defer finish(&err)
+
+	res, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
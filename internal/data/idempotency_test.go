@@ -0,0 +1,48 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestIdempotencyLostClaim covers a request that outlives its lock: once
+// another request has claimed the key, completing or releasing the stale
+// claim must leave the new one alone.
+func TestIdempotencyLostClaim(t *testing.T) {
+	m := NewMemoryModels().Idempotency
+	ctx := context.Background()
+
+	stale, fresh := []byte("stale"), []byte("fresh")
+
+	if _, err := m.Begin(ctx, 1, "key", stale, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if _, err := m.Begin(ctx, 1, "key", fresh, time.Minute); err != nil {
+		t.Fatalf("claiming the expired key: %v", err)
+	}
+
+	err := m.Complete(ctx, 1, "key", stale, &StoredResponse{Status: 201}, time.Hour)
+	if !errors.Is(err, ErrIdempotencyLost) {
+		t.Errorf("stale Complete: got error %v, want %v", err, ErrIdempotencyLost)
+	}
+	if err := m.Release(ctx, 1, "key", stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Begin(ctx, 1, "key", fresh, time.Minute); !errors.Is(err, ErrIdempotencyInFlight) {
+		t.Fatalf("fresh claim: got error %v, want %v", err, ErrIdempotencyInFlight)
+	}
+
+	if err := m.Complete(ctx, 1, "key", fresh, &StoredResponse{Status: 200}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := m.Begin(ctx, 1, "key", fresh, time.Minute)
+	if err != nil || stored == nil || stored.Status != 200 {
+		t.Errorf("got %+v, %v, want the fresh response", stored, err)
+	}
+}
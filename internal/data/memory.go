@@ -0,0 +1,810 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memoryStore backs the in-memory repositories. It mirrors the constraints of
+// the Postgres schema that handlers rely on: optimistic locking through
+// version, case-insensitive unique emails and tokens that stop resolving once
+// they expire.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	movies      map[int64]*Movie
+	lastMovieID int64
+
+	users      map[int64]*User
+	lastUserID int64
+
+	tokens map[[32]byte]*Token
+
+	idempotency map[idempotencyKey]*idempotencyRecord
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		movies:      make(map[int64]*Movie),
+		users:       make(map[int64]*User),
+		tokens:      make(map[[32]byte]*Token),
+		idempotency: make(map[idempotencyKey]*idempotencyRecord),
+	}
+}
+
+// now mimics the timestamp(0) columns, which drop fractional seconds.
+func (s *memoryStore) now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func cloneMovie(movie *Movie) *Movie {
+	clone := *movie
+	clone.Genres = append([]string(nil), movie.Genres...)
+	return &clone
+}
+
+// projectMovie copies only the selected columns, leaving the rest zeroed just
+// like a narrower SELECT list would.
+func projectMovie(movie *Movie, columns []string) *Movie {
+	var projected Movie
+
+	for _, column := range columns {
+		switch column {
+		case "id":
+			projected.ID = movie.ID
+		case "created_at":
+			projected.CreatedAt = movie.CreatedAt
+		case "title":
+			projected.Title = movie.Title
+		case "year":
+			projected.Year = movie.Year
+		case "runtime":
+			projected.Runtime = movie.Runtime
+		case "genres":
+			projected.Genres = append([]string(nil), movie.Genres...)
+		case "version":
+			projected.Version = movie.Version
+		}
+	}
+
+	return &projected
+}
+
+type MemoryMovieModel struct {
+	store *memoryStore
+}
+
+func (m MemoryMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.lastMovieID++
+
+	movie.ID = m.store.lastMovieID
+	movie.CreatedAt = m.store.now()
+	movie.Version = 1
+
+	m.store.movies[movie.ID] = cloneMovie(movie)
+	return nil
+}
+
+func (m MemoryMovieModel) Get(ctx context.Context, id int64, fields []string) (*Movie, error) {
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+
+	movie, found := m.store.movies[id]
+	if !found {
+		return nil, ErrRecordNotFound
+	}
+
+	return projectMovie(movie, movieColumns(fields)), nil
+}
+
+func (m MemoryMovieModel) GetAll(ctx context.Context, filter MovieFilter, filters Filters, fields []string) ([]*Movie, Metadata, error) {
+	return getAllFuzzy(filter, filters, fields, m.getAll)
+}
+
+func (m MemoryMovieModel) getAll(filter MovieFilter, filters Filters, fields []string) ([]*Movie, Metadata, error) {
+
+	var cursor Cursor
+	if filters.Cursor != "" {
+		var err error
+		cursor, err = filters.decodedCursor()
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	terms := filters.sortTerms()
+
+	m.store.mu.RLock()
+
+	matches := []*Movie{}
+	for _, movie := range m.store.movies {
+		if !filter.matches(movie) {
+			continue
+		}
+
+		if filters.Cursor != "" {
+			position := compareSortKeys(movie.sortKey, cursor.Keys, terms)
+			if (cursor.Before && position >= 0) || (!cursor.Before && position <= 0) {
+				continue
+			}
+		}
+
+		matches = append(matches, cloneMovie(movie))
+	}
+
+	m.store.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		order := compareMovies(matches[i], matches[j], terms)
+		if cursor.Before {
+			order = -order
+		}
+		return order < 0
+	})
+
+	totalrecords := 0
+	if filters.IncludeTotal {
+		totalrecords = len(matches)
+	}
+
+	start := filters.Offset()
+	if start > len(matches) {
+		start = len(matches)
+	}
+
+	end := start + filters.Limit() + 1
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	columns := movieColumns(fields, filters.sortColumns()...)
+
+	movies := []*Movie{}
+	for _, movie := range matches[start:end] {
+		movies = append(movies, projectMovie(movie, columns))
+	}
+
+	more := len(movies) > filters.Limit()
+	if more {
+		movies = movies[:filters.Limit()]
+	}
+
+	if cursor.Before {
+		for i, j := 0, len(movies)-1; i < j; i, j = i+1, j-1 {
+			movies[i], movies[j] = movies[j], movies[i]
+		}
+	}
+
+	metadata, err := calculateKeysetMetadata(movies, totalrecords, more, cursor, filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return movies, metadata, nil
+}
+
+// Search approximates the Postgres full-text search: every word of the query
+// has to appear in the title (words prefixed with - must not), there is no
+// stemming, and the rank is the share of title words that matched.
+func (m MemoryMovieModel) Search(ctx context.Context, q SearchQuery, filters Filters) ([]*SearchResult, Metadata, error) {
+
+	var required, excluded []string
+	for _, field := range strings.Fields(q.Query) {
+		words := simpleWords(field)
+		if strings.HasPrefix(field, "-") && !q.Prefix {
+			excluded = append(excluded, words...)
+		} else {
+			required = append(required, words...)
+		}
+	}
+
+	matchWord := func(word string) bool {
+		for i, term := range required {
+			if word == term || (q.Prefix && i == len(required)-1 && strings.HasPrefix(word, term)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	m.store.mu.RLock()
+
+	results := []*SearchResult{}
+	for _, movie := range m.store.movies {
+		words := simpleWords(movie.Title)
+
+		found := 0
+		for i, term := range required {
+			prefix := q.Prefix && i == len(required)-1
+			for _, word := range words {
+				if word == term || (prefix && strings.HasPrefix(word, term)) {
+					found++
+					break
+				}
+			}
+		}
+
+		if len(required) == 0 || found < len(required) || containsAny(words, excluded) {
+			continue
+		}
+
+		matched := 0
+		for _, word := range words {
+			if matchWord(word) {
+				matched++
+			}
+		}
+
+		results = append(results, &SearchResult{
+			Movie:    cloneMovie(movie),
+			Rank:     float32(matched) / float32(len(words)),
+			Headline: highlightWords(movie.Title, matchWord),
+		})
+	}
+
+	m.store.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID < results[j].ID
+	})
+
+	totalrecords := len(results)
+
+	start := filters.Offset()
+	if start > len(results) {
+		start = len(results)
+	}
+
+	end := start + filters.Limit()
+	if end > len(results) {
+		end = len(results)
+	}
+
+	return results[start:end], CalculateMetadata(totalrecords, filters.Page, filters.PageSize), nil
+}
+
+// Autocomplete scores titles by how much of the typed text's trigrams they
+// contain, which is close to what pg_trgm's word_similarity measures, and
+// applies the same 0.6 default threshold.
+func (m MemoryMovieModel) Autocomplete(ctx context.Context, q string, limit int) ([]*Suggestion, error) {
+	m.store.mu.RLock()
+
+	suggestions := []*Suggestion{}
+	for _, movie := range m.store.movies {
+		score := wordSimilarity(q, movie.Title)
+		if score >= 0.6 {
+			suggestions = append(suggestions, &Suggestion{ID: movie.ID, Title: movie.Title, Score: score})
+		}
+	}
+
+	m.store.mu.RUnlock()
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].ID < suggestions[j].ID
+	})
+
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+
+	return suggestions, nil
+}
+
+// Export takes a snapshot of the matching movies up front, which gives the same
+// consistency as the read-only transaction of the Postgres implementation.
+func (m MemoryMovieModel) Export(ctx context.Context, filter MovieFilter, batchsize int, fn func([]*Movie) error) error {
+	m.store.mu.RLock()
+
+	matches := []*Movie{}
+	for _, movie := range m.store.movies {
+		if filter.matches(movie) {
+			matches = append(matches, cloneMovie(movie))
+		}
+	}
+
+	m.store.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ID < matches[j].ID
+	})
+
+	for start := 0; start < len(matches); start += batchsize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + batchsize
+		if end > len(matches) {
+			end = len(matches)
+		}
+
+		err := fn(matches[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m MemoryMovieModel) Update(ctx context.Context, movie *Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	stored, found := m.store.movies[movie.ID]
+	if !found || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	movie.Version++
+
+	updated := cloneMovie(movie)
+	updated.CreatedAt = stored.CreatedAt
+
+	m.store.movies[movie.ID] = updated
+	return nil
+}
+
+func (m MemoryMovieModel) Delete(ctx context.Context, id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, found := m.store.movies[id]; !found {
+		return ErrRecordNotFound
+	}
+
+	delete(m.store.movies, id)
+	return nil
+}
+
+// matches evaluates the filter the way the conditions rendered for Postgres
+// do, with the simple text search configuration reduced to matching lowercase
+// words.
+func (f MovieFilter) matches(movie *Movie) bool {
+	switch {
+	case f.Title != "" && f.similarTitle:
+		if similarity(movie.Title, f.Title) < 0.3 {
+			return false
+		}
+	case f.Title != "":
+		if !containsAll(simpleWords(movie.Title), simpleWords(f.Title)) {
+			return false
+		}
+	}
+
+	if !containsAll(movie.Genres, f.Genres) {
+		return false
+	}
+	if len(f.GenresAny) > 0 && !containsAny(movie.Genres, f.GenresAny) {
+		return false
+	}
+	if containsAny(movie.Genres, f.GenresExclude) {
+		return false
+	}
+
+	if (f.YearMin != nil && int(movie.Year) < *f.YearMin) || (f.YearMax != nil && int(movie.Year) > *f.YearMax) {
+		return false
+	}
+	if (f.RuntimeMin != nil && int(movie.Runtime) < *f.RuntimeMin) || (f.RuntimeMax != nil && int(movie.Runtime) > *f.RuntimeMax) {
+		return false
+	}
+	if (f.CreatedAfter != nil && !movie.CreatedAt.After(*f.CreatedAfter)) || (f.CreatedBefore != nil && !movie.CreatedAt.Before(*f.CreatedBefore)) {
+		return false
+	}
+
+	return true
+}
+
+// compareSortKeys orders a row against a list of sort key values, honouring
+// the direction of every term. It is negative when the row comes first.
+func compareSortKeys(key func(column string) interface{}, keys []interface{}, terms []sortTerm) int {
+	for i, term := range terms {
+		order := compareKeys(key(term.Column), keys[i])
+		if term.Descending {
+			order = -order
+		}
+		if order != 0 {
+			return order
+		}
+	}
+	return 0
+}
+
+func compareMovies(a, b *Movie, terms []sortTerm) int {
+	keys := []interface{}{}
+	for _, term := range terms {
+		keys = append(keys, b.sortKey(term.Column))
+	}
+	return compareSortKeys(a.sortKey, keys, terms)
+}
+
+func compareKeys(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	case int64:
+		b, _ := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+	return 0
+}
+
+func containsAll(values, wanted []string) bool {
+	for _, w := range wanted {
+		if !containsAny(values, []string{w}) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// simpleWords splits text into lowercase words the way the simple text search
+// configuration does.
+func simpleWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// highlightWords wraps every word of s accepted by match in <mark> tags,
+// HTML escaping the words and the text between them, so the result is safe
+// to render as HTML like the headlines ts_headline returns.
+func highlightWords(s string, match func(word string) bool) string {
+	var b strings.Builder
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+			b.WriteString(html.EscapeString(string(runes[i])))
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j])) {
+			j++
+		}
+
+		word := string(runes[i:j])
+		if match(strings.ToLower(word)) {
+			b.WriteString("<mark>" + html.EscapeString(word) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(word))
+		}
+		i = j
+	}
+
+	return b.String()
+}
+
+// trigrams returns the pg_trgm trigram set of s: every word is lowercased and
+// padded with two spaces in front and one behind before being cut up.
+func trigrams(s string) map[string]bool {
+	set := make(map[string]bool)
+
+	for _, word := range simpleWords(s) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+
+	return set
+}
+
+// similarity is pg_trgm's similarity(): shared trigrams over all trigrams.
+func similarity(a, b string) float32 {
+	ta, tb := trigrams(a), trigrams(b)
+
+	shared := 0
+	for trigram := range ta {
+		if tb[trigram] {
+			shared++
+		}
+	}
+
+	union := len(ta) + len(tb) - shared
+	if union == 0 {
+		return 0
+	}
+	return float32(shared) / float32(union)
+}
+
+// wordSimilarity is the share of the trigrams of q found in s.
+func wordSimilarity(q, s string) float32 {
+	tq, ts := trigrams(q), trigrams(s)
+	if len(tq) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for trigram := range tq {
+		if ts[trigram] {
+			shared++
+		}
+	}
+	return float32(shared) / float32(len(tq))
+}
+
+type MemoryUserModel struct {
+	store *memoryStore
+}
+
+func cloneUser(user *User) *User {
+	clone := *user
+	clone.Password = password{Hash: append([]byte(nil), user.Password.Hash...)}
+	return &clone
+}
+
+// emailTaken reports whether another user already has the address, compared
+// case-insensitively like the citext column.
+func (s *memoryStore) emailTaken(email string, exceptID int64) bool {
+	for _, user := range s.users {
+		if user.ID != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m MemoryUserModel) Insert(ctx context.Context, user *User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if m.store.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+
+	m.store.lastUserID++
+
+	user.ID = m.store.lastUserID
+	user.CreatedAt = m.store.now()
+	user.Version = 1
+
+	m.store.users[user.ID] = cloneUser(user)
+	return nil
+}
+
+func (m MemoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+
+	for _, user := range m.store.users {
+		if strings.EqualFold(user.Email, email) {
+			return cloneUser(user), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m MemoryUserModel) Update(ctx context.Context, user *User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if m.store.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	stored, found := m.store.users[user.ID]
+	if !found || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	user.Version++
+
+	updated := cloneUser(user)
+	updated.CreatedAt = stored.CreatedAt
+
+	m.store.users[user.ID] = updated
+	return nil
+}
+
+func (m MemoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+
+	token, found := m.store.tokens[tokenHash]
+	if !found || token.Scope != tokenScope || !token.Expity.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	user, found := m.store.users[token.UsrID]
+	if !found {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneUser(user), nil
+}
+
+type MemoryTokenModel struct {
+	store *memoryStore
+}
+
+var errMemoryUnknownUser = errors.New("token references a user that does not exist")
+
+func (m MemoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m MemoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, found := m.store.users[token.UsrID]; !found {
+		return errMemoryUnknownUser
+	}
+
+	// Expired tokens can never resolve again, this is as good a moment as any to
+	// forget about them.
+	now := time.Now()
+	for hash, stored := range m.store.tokens {
+		if !stored.Expity.After(now) {
+			delete(m.store.tokens, hash)
+		}
+	}
+
+	var hash [32]byte
+	copy(hash[:], token.Hash)
+
+	stored := *token
+	stored.Plaintext = ""
+	stored.Expity = token.Expity.Truncate(time.Second)
+
+	m.store.tokens[hash] = &stored
+	return nil
+}
+
+func (m MemoryTokenModel) DeleteForAllUser(ctx context.Context, scope string, userID int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for hash, token := range m.store.tokens {
+		if token.Scope == scope && token.UsrID == userID {
+			delete(m.store.tokens, hash)
+		}
+	}
+
+	return nil
+}
+
+type idempotencyKey struct {
+	userID int64
+	key    string
+}
+
+type idempotencyRecord struct {
+	requestHash []byte
+	response    *StoredResponse
+	expiry      time.Time
+}
+
+type MemoryIdempotencyModel struct {
+	store *memoryStore
+}
+
+func (m MemoryIdempotencyModel) Begin(ctx context.Context, userID int64, key string, requestHash []byte, lockTTL time.Duration) (*StoredResponse, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	now := time.Now()
+	id := idempotencyKey{userID: userID, key: key}
+
+	record, found := m.store.idempotency[id]
+	if !found || !record.expiry.After(now) {
+		m.store.idempotency[id] = &idempotencyRecord{
+			requestHash: append([]byte(nil), requestHash...),
+			expiry:      now.Add(lockTTL),
+		}
+		return nil, nil
+	}
+
+	if !bytes.Equal(record.requestHash, requestHash) {
+		return nil, ErrIdempotencyMismatch
+	}
+
+	if record.response == nil {
+		return nil, ErrIdempotencyInFlight
+	}
+
+	return cloneStoredResponse(record.response), nil
+}
+
+func (m MemoryIdempotencyModel) Complete(ctx context.Context, userID int64, key string, requestHash []byte, response *StoredResponse, ttl time.Duration) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	record, found := m.store.idempotency[idempotencyKey{userID: userID, key: key}]
+	if !found || record.response != nil || !bytes.Equal(record.requestHash, requestHash) {
+		return ErrIdempotencyLost
+	}
+
+	record.response = cloneStoredResponse(response)
+	record.expiry = time.Now().Add(ttl)
+
+	return nil
+}
+
+func (m MemoryIdempotencyModel) Release(ctx context.Context, userID int64, key string, requestHash []byte) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	id := idempotencyKey{userID: userID, key: key}
+	if record, found := m.store.idempotency[id]; found && record.response == nil && bytes.Equal(record.requestHash, requestHash) {
+		delete(m.store.idempotency, id)
+	}
+
+	return nil
+}
+
+func (m MemoryIdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	now := time.Now()
+	var removed int64
+
+	for id, record := range m.store.idempotency {
+		if !record.expiry.After(now) {
+			delete(m.store.idempotency, id)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+func cloneStoredResponse(response *StoredResponse) *StoredResponse {
+	clone := &StoredResponse{Status: response.Status, Body: append([]byte(nil), response.Body...)}
+
+	if response.Header != nil {
+		clone.Header = make(map[string][]string, len(response.Header))
+		for name, values := range response.Header {
+			clone.Header[name] = append([]string(nil), values...)
+		}
+	}
+
+	return clone
+}
@@ -1,7 +1,13 @@
 package data
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
+	"github.com/lib/pq"
 )
 
 var (
@@ -9,8 +15,101 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DefaultQueryTimeout bounds every query of the Postgres models when they are
+// built without an explicit timeout.
+const DefaultQueryTimeout = 3 * time.Second
+
+// queryContext derives the context a single query runs under. It stays tied
+// to the caller's context, so a client going away or the server shutting down
+// cancels the query instead of letting it run to the timeout. The query is
+// traced as a span named after operation, ended by the returned finish func.
+// Callers defer it with their named error result, so a failed query marks the
+// span as failed; a missing record is an answer rather than a failure.
+func queryContext(ctx context.Context, timeout time.Duration, operation string) (context.Context, func(err *error)) {
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+
+	ctx, span := tracing.StartClient(ctx, operation)
+	span.SetAttribute("db.system", "postgresql")
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	return ctx, func(err *error) {
+		if !errors.Is(*err, sql.ErrNoRows) && !errors.Is(*err, ErrRecordNotFound) {
+			span.RecordError(*err)
+		}
+		cancel()
+		span.End()
+	}
+}
+
+// IsTimeout reports whether err means a query ran out of time: either its
+// context expired, or Postgres cancelled the statement (SQLSTATE 57014), which
+// is how lib/pq usually reports the expiry once the query is on the server.
+func IsTimeout(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "57014"
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// MovieRepository is implemented by MovieModel on top of Postgres and by
+// MemoryMovieModel for local demos and tests.
+type MovieRepository interface {
+	Insert(ctx context.Context, movie *Movie) error
+	Get(ctx context.Context, id int64, fields []string) (*Movie, error)
+	GetAll(ctx context.Context, filter MovieFilter, filters Filters, fields []string) ([]*Movie, Metadata, error)
+	Search(ctx context.Context, q SearchQuery, filters Filters) ([]*SearchResult, Metadata, error)
+	Autocomplete(ctx context.Context, q string, limit int) ([]*Suggestion, error)
+	Export(ctx context.Context, filter MovieFilter, batchsize int, fn func([]*Movie) error) error
+	Update(ctx context.Context, movie *Movie) error
+	Delete(ctx context.Context, id int64) error
+}
+
+// UserRepository is implemented by UserModel and MemoryUserModel.
+type UserRepository interface {
+	Insert(ctx context.Context, user *User) error
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+}
+
+// TokenRepository is implemented by TokenModel and MemoryTokenModel.
+type TokenRepository interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteForAllUser(ctx context.Context, scope string, userID int64) error
+}
+
 type Models struct {
-	Movies MovieModel
-	Users  UserModel
-	Tokens TokenModel
+	Movies      MovieRepository
+	Users       UserRepository
+	Tokens      TokenRepository
+	Idempotency IdempotencyRepository
+}
+
+// NewModels returns the Postgres backed repositories, each query bounded by
+// timeout on top of the context it is given.
+func NewModels(db *sql.DB, timeout time.Duration) Models {
+	return Models{
+		Movies:      MovieModel{DB: db, QueryTimeout: timeout},
+		Users:       UserModel{DB: db, QueryTimeout: timeout},
+		Tokens:      TokenModel{DB: db, QueryTimeout: timeout},
+		Idempotency: IdempotencyModel{DB: db, QueryTimeout: timeout},
+	}
+}
+
+// NewMemoryModels returns repositories that keep everything in process memory,
+// sharing one store so that tokens resolve to the users they were issued for.
+func NewMemoryModels() Models {
+	store := newMemoryStore()
+
+	return Models{
+		Movies:      MemoryMovieModel{store: store},
+		Users:       MemoryUserModel{store: store},
+		Tokens:      MemoryTokenModel{store: store},
+		Idempotency: MemoryIdempotencyModel{store: store},
+	}
 }
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
+)
+
+type spanRecorder struct{ spans []tracing.SpanData }
+
+func (r *spanRecorder) ExportSpan(span tracing.SpanData)   { r.spans = append(r.spans, span) }
+func (r *spanRecorder) Shutdown(ctx context.Context) error { return nil }
+
+func TestQueryContextSpanError(t *testing.T) {
+	recorder := &spanRecorder{}
+	tracing.SetExporter(recorder)
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"success", nil, ""},
+		{"failed query", errors.New(`pq: relation "movies" does not exist`), `pq: relation "movies" does not exist`},
+		{"wrapped failure", fmt.Errorf("scan: %w", sql.ErrConnDone), "scan: " + sql.ErrConnDone.Error()},
+		{"no rows", sql.ErrNoRows, ""},
+		{"not found", ErrRecordNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder.spans = nil
+
+			ctx, finish := queryContext(context.Background(), 0, "MovieModel.Get")
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("query context has no deadline")
+			}
+
+			err := tt.err
+			finish(&err)
+
+			if ctx.Err() == nil {
+				t.Error("query context not cancelled by finish")
+			}
+
+			if len(recorder.spans) != 1 {
+				t.Fatalf("got %d spans, want 1", len(recorder.spans))
+			}
+
+			span := recorder.spans[0]
+			if span.Name != "MovieModel.Get" || span.Kind != tracing.KindClient {
+				t.Errorf("got span %q of kind %v", span.Name, span.Kind)
+			}
+			if span.Error != tt.want {
+				t.Errorf("got span error %q, want %q", span.Error, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
+	"github.com/lib/pq"
+)
+
+// MovieFilter holds the row filters shared by the movie listing and export
+// endpoints. Nil bounds and empty lists are simply left out of the query.
+type MovieFilter struct {
+	Title         string
+	Fuzzy         bool
+	Genres        []string
+	GenresAny     []string
+	GenresExclude []string
+	YearMin       *int
+	YearMax       *int
+	RuntimeMin    *int
+	RuntimeMax    *int
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+
+	// similarTitle swaps the full-text title match for trigram similarity, it
+	// is set internally for the fuzzy fallback.
+	similarTitle bool
+}
+
+func ValidateMovieFilter(v *validator.Validator, f MovieFilter) {
+	var firstFilmYear, presentYear = 1_888, time.Now().Year()
+
+	var yearRange = validator.Params{"min": firstFilmYear, "max": presentYear}
+	if f.YearMin != nil {
+		v.Check(*f.YearMin >= firstFilmYear && *f.YearMin <= presentYear, "year_min", validator.CodeOutOfRange, yearRange)
+	}
+	if f.YearMax != nil {
+		v.Check(*f.YearMax >= firstFilmYear && *f.YearMax <= presentYear, "year_max", validator.CodeOutOfRange, yearRange)
+	}
+	if f.YearMin != nil && f.YearMax != nil {
+		v.Check(*f.YearMin <= *f.YearMax, "year_min", validator.CodeGreaterThanField, validator.Params{"field": "year_max"})
+	}
+
+	var minimumRuntime = validator.Params{"min": 1}
+	if f.RuntimeMin != nil {
+		v.Check(*f.RuntimeMin > 0, "runtime_min", validator.CodeTooSmall, minimumRuntime)
+	}
+	if f.RuntimeMax != nil {
+		v.Check(*f.RuntimeMax > 0, "runtime_max", validator.CodeTooSmall, minimumRuntime)
+	}
+	if f.RuntimeMin != nil && f.RuntimeMax != nil {
+		v.Check(*f.RuntimeMin <= *f.RuntimeMax, "runtime_min", validator.CodeGreaterThanField, validator.Params{"field": "runtime_max"})
+	}
+
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(f.CreatedAfter.Before(*f.CreatedBefore), "created_after", validator.CodeNotBefore, validator.Params{"field": "created_before"})
+	}
+
+	v.Check(validator.Unique(f.Genres), "genres", validator.CodeNotUnique, nil)
+	v.Check(validator.Unique(f.GenresAny), "genres_any", validator.CodeNotUnique, nil)
+	v.Check(validator.Unique(f.GenresExclude), "genres_exclude", validator.CodeNotUnique, nil)
+}
+
+// conditions renders the filter as a list of WHERE conditions, binding every
+// value into args so the statement stays fully parameterized.
+func (f MovieFilter) conditions(args *queryArgs) []string {
+	conditions := []string{}
+
+	switch {
+	case f.Title != "" && f.similarTitle:
+		conditions = append(conditions, fmt.Sprintf("title %% %s", args.add(f.Title)))
+	case f.Title != "":
+		conditions = append(conditions, fmt.Sprintf("to_tsvector('simple', title) @@ plainto_tsquery('simple', %s)", args.add(f.Title)))
+	}
+	if len(f.Genres) > 0 {
+		conditions = append(conditions, fmt.Sprintf("genres @> %s", args.add(pq.Array(f.Genres))))
+	}
+	if len(f.GenresAny) > 0 {
+		conditions = append(conditions, fmt.Sprintf("genres && %s", args.add(pq.Array(f.GenresAny))))
+	}
+	if len(f.GenresExclude) > 0 {
+		conditions = append(conditions, fmt.Sprintf("NOT genres && %s", args.add(pq.Array(f.GenresExclude))))
+	}
+	if f.YearMin != nil {
+		conditions = append(conditions, fmt.Sprintf("year >= %s", args.add(*f.YearMin)))
+	}
+	if f.YearMax != nil {
+		conditions = append(conditions, fmt.Sprintf("year <= %s", args.add(*f.YearMax)))
+	}
+	if f.RuntimeMin != nil {
+		conditions = append(conditions, fmt.Sprintf("runtime >= %s", args.add(*f.RuntimeMin)))
+	}
+	if f.RuntimeMax != nil {
+		conditions = append(conditions, fmt.Sprintf("runtime <= %s", args.add(*f.RuntimeMax)))
+	}
+	if f.CreatedAfter != nil {
+		conditions = append(conditions, fmt.Sprintf("created_at > %s", args.add(*f.CreatedAfter)))
+	}
+	if f.CreatedBefore != nil {
+		conditions = append(conditions, fmt.Sprintf("created_at < %s", args.add(*f.CreatedBefore)))
+	}
+
+	return conditions
+}
@@ -0,0 +1,75 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestMovieFilterConditions(t *testing.T) {
+	year, runtime := 1990, 120
+	after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter MovieFilter
+		want   []string
+		args   []interface{}
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "title",
+			filter: MovieFilter{Title: "godfather"},
+			want:   []string{"to_tsvector('simple', title) @@ plainto_tsquery('simple', $1)"},
+			args:   []interface{}{"godfather"},
+		},
+		{
+			name:   "similar title",
+			filter: MovieFilter{Title: "godfater", similarTitle: true},
+			want:   []string{"title % $1"},
+			args:   []interface{}{"godfater"},
+		},
+		{
+			name:   "genres",
+			filter: MovieFilter{Genres: []string{"crime"}, GenresAny: []string{"drama", "action"}, GenresExclude: []string{"animation"}},
+			want:   []string{"genres @> $1", "genres && $2", "NOT genres && $3"},
+			args:   []interface{}{pq.Array([]string{"crime"}), pq.Array([]string{"drama", "action"}), pq.Array([]string{"animation"})},
+		},
+		{
+			name:   "bounds",
+			filter: MovieFilter{YearMin: &year, YearMax: &year, RuntimeMin: &runtime, RuntimeMax: &runtime, CreatedAfter: &after, CreatedBefore: &after},
+			want:   []string{"year >= $1", "year <= $2", "runtime >= $3", "runtime <= $4", "created_at > $5", "created_at < $6"},
+			args:   []interface{}{year, year, runtime, runtime, after, after},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := queryArgs{}
+			got := tt.filter.conditions(&args)
+
+			if strings.Join(got, " | ") != strings.Join(tt.want, " | ") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if len(args) != len(tt.args) || (len(args) > 0 && !reflect.DeepEqual([]interface{}(args), tt.args)) {
+				t.Errorf("got args %#v, want %#v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestWhereClause(t *testing.T) {
+	if got := whereClause(nil); got != "" {
+		t.Errorf("got %q for no conditions, want nothing", got)
+	}
+
+	want := "WHERE year >= $1\n\t\tAND genres @> $2"
+	if got := whereClause([]string{"year >= $1", "genres @> $2"}); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
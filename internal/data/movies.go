@@ -5,8 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
 	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
 	"github.com/lib/pq"
 )
@@ -22,48 +24,84 @@ type Movie struct {
 }
 
 type MovieModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	QueryTimeout time.Duration
 }
 
-func ValidateMovie(v *validator.Validator, movie *Movie) {
-
-	var messageNotProvided = "must be provided"
+// MovieFieldSafeList is the allowlist for sparse fieldsets (?fields=) on movie
+// responses, in the order the columns are selected.
+var MovieFieldSafeList = []string{"id", "created_at", "title", "year", "runtime", "genres", "version"}
+
+// movieScanTargets maps each selectable field to the movie member its column
+// gets scanned into.
+var movieScanTargets = map[string]func(*Movie) interface{}{
+	"id":         func(m *Movie) interface{} { return &m.ID },
+	"created_at": func(m *Movie) interface{} { return &m.CreatedAt },
+	"title":      func(m *Movie) interface{} { return &m.Title },
+	"year":       func(m *Movie) interface{} { return &m.Year },
+	"runtime":    func(m *Movie) interface{} { return &m.Runtime },
+	"genres":     func(m *Movie) interface{} { return pq.Array(&m.Genres) },
+	"version":    func(m *Movie) interface{} { return &m.Version },
+}
 
-	v.Check(len(movie.Genres) > 0, "genres", messageNotProvided)
-	v.Check(movie.Title != "", "title", messageNotProvided)
-	v.Check(movie.Year != 0, "year", messageNotProvided)
-	v.Check(movie.Runtime != 0, "runtime", messageNotProvided)
+// movieColumns returns the columns to select for the requested fields, or all
+// of them when no fields were requested. id and any extra columns the query
+// itself depends on (such as sort keys for cursors) are always included.
+func movieColumns(fields []string, extra ...string) []string {
+	if len(fields) == 0 {
+		return MovieFieldSafeList
+	}
 
-	var messageMore = "must be more than"
-	var messageLess = "must be less than"
+	wanted := append([]string{"id"}, extra...)
+	wanted = append(wanted, fields...)
 
-	var minimumGenreAmount = 1
-	var maxGenreAmount = 5
+	columns := []string{}
+	for _, column := range MovieFieldSafeList {
+		if validator.In(column, wanted...) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
 
-	v.Check(len(movie.Genres) >= minimumGenreAmount, "genres", fmt.Sprintf(messageMore+" %v genre, add a genre", minimumGenreAmount))
-	v.Check(len(movie.Genres) <= maxGenreAmount, "genres", fmt.Sprintf(messageLess+"%v genres, remove a genre", maxGenreAmount))
+// scanTargets returns the destinations for a row selected with columns.
+func (movie *Movie) scanTargets(columns []string) []interface{} {
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		targets[i] = movieScanTargets[column](movie)
+	}
+	return targets
+}
 
-	var minimimMovieRuntime = 0
+func ValidateMovie(v *validator.Validator, movie *Movie) {
+	v.Check(len(movie.Genres) > 0, "genres", validator.CodeRequired, nil)
+	v.Check(movie.Title != "", "title", validator.CodeRequired, nil)
+	v.Check(movie.Year != 0, "year", validator.CodeRequired, nil)
+	v.Check(movie.Runtime != 0, "runtime", validator.CodeRequired, nil)
 
-	v.Check(movie.Runtime > 0, "runtime", fmt.Sprintf(messageMore+" %d minutes, input a positive integer", minimimMovieRuntime))
+	var maxGenreAmount = 5
 
-	var maximumCharacterAmount = 500
+	v.Check(len(movie.Genres) <= maxGenreAmount, "genres", validator.CodeTooMany, validator.Params{"max": maxGenreAmount})
+	v.Check(validator.Unique(movie.Genres), "genres", validator.CodeNotUnique, nil)
 
-	v.Check(len(movie.Title) < maximumCharacterAmount, "title", fmt.Sprintf(messageLess+" it must be less than %d bytes in length", maximumCharacterAmount))
+	// A missing runtime already failed as required.
+	var minimumMovieRuntime = 1
 
-	var presentYear = int32(time.Now().Year())
+	if movie.Runtime != 0 {
+		v.Check(movie.Runtime >= Runtime(minimumMovieRuntime), "runtime", validator.CodeTooSmall, validator.Params{"min": minimumMovieRuntime})
+	}
 
-	v.Check(movie.Year <= presentYear, "creation_date", fmt.Sprintf(messageLess+" it must have a creation date not set in the future, the present year is %d", presentYear))
+	var maximumCharacterAmount = 499
 
-	var firstFilmYear = int32(1_888)
+	v.Check(len(movie.Title) <= maximumCharacterAmount, "title", validator.CodeTooLong, validator.Params{"max": maximumCharacterAmount})
 
-	v.Check(movie.Year >= firstFilmYear, "creation_date", fmt.Sprintf(messageMore+" %d, the first film dates from %d", firstFilmYear, firstFilmYear))
+	// The first film dates from 1888, and none can be dated in the future.
+	var firstFilmYear, presentYear = int32(1_888), int32(time.Now().Year())
 
-	var messageUniqueValues = "must have non-repeating genre tags"
-	v.Check(validator.Unique(movie.Genres), "genres", messageUniqueValues)
+	v.Check(movie.Year >= firstFilmYear && movie.Year <= presentYear, "creation_date", validator.CodeOutOfRange, validator.Params{"min": firstFilmYear, "max": presentYear})
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) (err error) {
 
 	query := `
 		INSERT INTO movies (title, year, runtime, genres)
@@ -73,39 +111,34 @@ func (m MovieModel) Insert(movie *Movie) error {
 
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "MovieModel.Insert")
+	defer finish(&err)
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+// Get fetches a single movie, selecting only the given fields (every field
+// when fields is empty).
+func (m MovieModel) Get(ctx context.Context, id int64, fields []string) (_ *Movie, err error) {
 
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `
-		SELECT id,created_at,title,year,runtime,genres,version
+	columns := movieColumns(fields)
+
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM movies
 		WHERE id = $1
-		`
+		`, strings.Join(columns, ","))
 
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "MovieModel.Get")
+	defer finish(&err)
 
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&movie.ID,
-		&movie.CreatedAt,
-		&movie.Title,
-		&movie.Year,
-		&movie.Runtime,
-		pq.Array(&movie.Genres),
-		&movie.Version,
-	)
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(movie.scanTargets(columns)...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -118,23 +151,84 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// GetAll lists a page of movies matching filter, selecting only the given
+// fields (every field when fields is empty). With filter.Fuzzy set, a title
+// search that finds nothing is retried with trigram similarity so misspelled
+// titles still match, and the metadata says so.
+func (m MovieModel) GetAll(ctx context.Context, filter MovieFilter, filters Filters, fields []string) ([]*Movie, Metadata, error) {
+	return getAllFuzzy(filter, filters, fields, func(filter MovieFilter, filters Filters, fields []string) ([]*Movie, Metadata, error) {
+		return m.getAll(ctx, filter, filters, fields)
+	})
+}
+
+// getAllFuzzy runs getAll, falling back to trigram similarity for fuzzy title
+// searches the exact search finds no movie at all for. Past the first page an
+// empty page may only mean the exact matches ran out, so the first page is
+// checked before the fallback turns the rest of the listing fuzzy.
+func getAllFuzzy(filter MovieFilter, filters Filters, fields []string, getAll func(MovieFilter, Filters, []string) ([]*Movie, Metadata, error)) ([]*Movie, Metadata, error) {
+	movies, metadata, err := getAll(filter, filters, fields)
+	if err != nil || len(movies) > 0 || !filter.Fuzzy || filter.Title == "" {
+		return movies, metadata, err
+	}
+
+	if filters.Page > 1 || filters.Cursor != "" {
+		first := filters
+		first.Page, first.Cursor, first.IncludeTotal = 1, "", false
+
+		exact, _, err := getAll(filter, first, []string{"id"})
+		if err != nil || len(exact) > 0 {
+			return movies, metadata, err
+		}
+	}
+
+	filter.similarTitle = true
 
+	movies, metadata, err = getAll(filter, filters, fields)
+	metadata.Fuzzy = len(movies) > 0
+	return movies, metadata, err
+}
+
+func (m MovieModel) getAll(ctx context.Context, filter MovieFilter, filters Filters, fields []string) (_ []*Movie, _ Metadata, err error) {
+
+	args := queryArgs{}
+	conditions := filter.conditions(&args)
+
+	var cursor Cursor
+	if filters.Cursor != "" {
+		cursor, err = filters.decodedCursor()
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		conditions = append(conditions, filters.keysetCondition(cursor, &args))
+	}
+
+	columns := movieColumns(fields, filters.sortColumns()...)
+
+	// The window count has to scan every matching row, so it is only computed
+	// when the caller asked for the total.
+	count := "0"
+	if filters.IncludeTotal {
+		count = "count(*) OVER()"
+	}
+
+	// One row past the page size is fetched to find out whether another page
+	// follows without needing the total.
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT %s, %s
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 or $2  = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.SortColumn(), filters.SortDirection())
+		%s
+		ORDER BY %s
+		LIMIT %s OFFSET %s`, count, strings.Join(columns, ", "), whereClause(conditions), filters.orderBy(cursor.Before), args.add(filters.Limit()+1), args.add(filters.Offset()))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "MovieModel.GetAll")
+	defer finish(&err)
 
-	rows, err := m.DB.QueryContext(ctx, query, title, pq.Array(genres), filters.Limit(), filters.Offset())
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
+	defer rows.Close()
 
 	totalrecords := 0
 	movies := []*Movie{}
@@ -143,16 +237,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 		var movie Movie
 
-		err = rows.Scan(
-			&totalrecords,
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			pq.Array(&movie.Genres),
-			&movie.Version,
-		)
+		err = rows.Scan(append([]interface{}{&totalrecords}, movie.scanTargets(columns)...)...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -163,11 +248,175 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		return nil, Metadata{}, err
 	}
 
-	metadata := CalculateMetadata(totalrecords, filters.Page, filters.PageSize)
+	more := len(movies) > filters.Limit()
+	if more {
+		movies = movies[:filters.Limit()]
+	}
+
+	if cursor.Before {
+		for i, j := 0, len(movies)-1; i < j; i, j = i+1, j-1 {
+			movies[i], movies[j] = movies[j], movies[i]
+		}
+	}
+
+	var metadata Metadata
+	metadata, err = calculateKeysetMetadata(movies, totalrecords, more, cursor, filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
 	return movies, metadata, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+// calculateKeysetMetadata fills in the pagination metadata for a page of movies
+// and the cursors pointing at its neighbouring pages, if there are any.
+func calculateKeysetMetadata(movies []*Movie, totalrecords int, more bool, cursor Cursor, filters Filters) (Metadata, error) {
+	var metadata Metadata
+
+	switch {
+	case filters.Cursor != "":
+		metadata = Metadata{PageSize: filters.PageSize, TotalRecords: totalrecords}
+	case filters.IncludeTotal:
+		metadata = CalculateMetadata(totalrecords, filters.Page, filters.PageSize)
+	default:
+		metadata = Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1}
+	}
+
+	if len(movies) == 0 {
+		return metadata, nil
+	}
+
+	// Walking backwards the extra row tells us about earlier pages, and a later
+	// page always exists because we came from it; forwards it is the other way
+	// round, with the first offset page having nothing before it.
+	hasNext, hasPrev := more, filters.Cursor != "" || filters.Page > 1
+	if cursor.Before {
+		hasNext, hasPrev = true, more
+	}
+
+	var err error
+
+	if hasNext {
+		last := movies[len(movies)-1]
+		metadata.NextCursor, err = filters.newCursor(last.sortKey, false)
+		if err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	if hasPrev {
+		first := movies[0]
+		metadata.PrevCursor, err = filters.newCursor(first.sortKey, true)
+		if err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// sortKey returns the value of a sortable column for the movie, in the form it
+// gets stored in a cursor.
+func (movie *Movie) sortKey(column string) interface{} {
+	switch column {
+	case "title":
+		return movie.Title
+	case "year":
+		return int64(movie.Year)
+	case "runtime":
+		return int64(movie.Runtime)
+	default:
+		return movie.ID
+	}
+}
+
+// Export streams every movie matching the filter through a
+// server-side cursor, handing them to fn in batches of batchsize rows ordered by
+// id. The whole export runs in a single read-only transaction so the rows stay
+// consistent, and it is bound to ctx instead of the usual query timeout because
+// it lasts as long as the client keeps reading.
+func (m MovieModel) Export(ctx context.Context, filter MovieFilter, batchsize int, fn func([]*Movie) error) (err error) {
+
+	ctx, span := tracing.StartClient(ctx, "MovieModel.Export")
+	span.SetAttribute("db.system", "postgresql")
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := queryArgs{}
+
+	declare := fmt.Sprintf(`
+		DECLARE movies_export NO SCROLL CURSOR FOR
+		SELECT id, created_at, title, year, runtime, genres, version
+		FROM movies
+		%s
+		ORDER BY id ASC`, whereClause(filter.conditions(&args)))
+
+	_, err = tx.ExecContext(ctx, declare, args...)
+	if err != nil {
+		return err
+	}
+
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM movies_export", batchsize)
+
+	for {
+		rows, err := tx.QueryContext(ctx, fetch)
+		if err != nil {
+			return err
+		}
+
+		movies := make([]*Movie, 0, batchsize)
+
+		for rows.Next() {
+
+			var movie Movie
+
+			err = rows.Scan(
+				&movie.ID,
+				&movie.CreatedAt,
+				&movie.Title,
+				&movie.Year,
+				&movie.Runtime,
+				pq.Array(&movie.Genres),
+				&movie.Version,
+			)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			movies = append(movies, &movie)
+		}
+
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		if len(movies) == 0 {
+			break
+		}
+
+		err = fn(movies)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "CLOSE movies_export")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m MovieModel) Update(ctx context.Context, movie *Movie) (err error) {
 	query := `
 		UPDATE movies
 		SET title = $1, year = $2, runtime = $3, genres =$4, version = version+1
@@ -184,10 +433,10 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "MovieModel.Update")
+	defer finish(&err)
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -199,14 +448,14 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) (err error) {
 	query := `
 		DELETE FROM movies
 		WHERE id = $1
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "MovieModel.Delete")
+	defer finish(&err)
 
 	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
+)
+
+// searchVectors maps every supported text search configuration to the indexed
+// tsvector expression that matches it: the generated search_vector column for
+// english, and the expression index from the original title index for simple.
+var searchVectors = map[string]string{
+	"english": "search_vector",
+	"simple":  "to_tsvector('simple', title)",
+}
+
+var SearchConfigSafeList = []string{"english", "simple"}
+
+type SearchQuery struct {
+	Query  string
+	Config string
+	Prefix bool
+}
+
+// SearchResult is a movie together with how well it matched the query and a
+// snippet of its title with the matching words wrapped in <mark> tags.
+// Headline is safe HTML: the title is escaped before it is highlighted, so
+// the <mark> tags are the only markup it contains.
+type SearchResult struct {
+	*Movie
+	Rank     float32 `json:"rank"`
+	Headline string  `json:"headline"`
+}
+
+func ValidateSearchQuery(v *validator.Validator, q SearchQuery) {
+	v.Check(strings.TrimSpace(q.Query) != "", "q", validator.CodeRequired, nil)
+
+	var maximumQueryLength = 200
+	v.Check(len(q.Query) <= maximumQueryLength, "q", validator.CodeTooLong, validator.Params{"max": maximumQueryLength})
+
+	if q.Prefix && strings.TrimSpace(q.Query) != "" {
+		v.Check(len(prefixTerms(q.Query)) > 0, "q", validator.CodeNoTerms, nil)
+	}
+
+	v.Check(validator.In(q.Config, SearchConfigSafeList...), "lang", validator.CodeNotAllowed, validator.Params{"value": q.Config, "allowed": SearchConfigSafeList})
+}
+
+// prefixTerms splits a type-ahead query into plain words, dropping anything
+// that could be mistaken for tsquery syntax.
+func prefixTerms(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// tsquery returns the SQL expression turning the query into a tsquery under the
+// configuration bound at config. Regular searches accept the web search syntax
+// (quoted phrases, OR, -exclusions); prefix searches AND every word together
+// and let the last one match as a prefix for type-ahead.
+func (q SearchQuery) tsquery(config string, args *queryArgs) string {
+	if q.Prefix && strings.TrimSpace(q.Query) != "" {
+		terms := prefixTerms(q.Query)
+		terms[len(terms)-1] += ":*"
+		return fmt.Sprintf("to_tsquery(%s::regconfig, %s)", config, args.add(strings.Join(terms, " & ")))
+	}
+
+	return fmt.Sprintf("websearch_to_tsquery(%s::regconfig, %s)", config, args.add(q.Query))
+}
+
+// escapedTitle is the title escaped the way html.EscapeString does, for
+// ts_headline to highlight without letting markup in the title through.
+const escapedTitle = `replace(replace(replace(replace(replace(title, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;')`
+
+// Search ranks movies against a full-text query with ts_rank_cd. The page of
+// matches is picked first so that ts_headline, which is expensive, only runs
+// over the rows that are returned.
+func (m MovieModel) Search(ctx context.Context, q SearchQuery, filters Filters) (_ []*SearchResult, _ Metadata, err error) {
+
+	vector := searchVectors[q.Config]
+
+	args := queryArgs{}
+	config := args.add(q.Config)
+	tsquery := q.tsquery(config, &args)
+
+	query := fmt.Sprintf(`
+		SELECT total, id, created_at, title, year, runtime, genres, version, rank,
+			ts_headline(%[1]s::regconfig, %[6]s, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')
+		FROM (
+			SELECT count(*) OVER() AS total, movies.*, ts_rank_cd(%[2]s, query) AS rank, query
+			FROM movies, %[3]s query
+			WHERE %[2]s @@ query
+			ORDER BY rank DESC, id ASC
+			LIMIT %[4]s OFFSET %[5]s
+		) matches
+		ORDER BY rank DESC, id ASC`, config, vector, tsquery, args.add(filters.Limit()), args.add(filters.Offset()), escapedTitle)
+
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "MovieModel.Search")
+	defer finish(&err)
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalrecords := 0
+	results := []*SearchResult{}
+
+	for rows.Next() {
+
+		result := SearchResult{Movie: &Movie{}}
+
+		err = rows.Scan(append(append([]interface{}{&totalrecords}, result.scanTargets(MovieFieldSafeList)...), &result.Rank, &result.Headline)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		results = append(results, &result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := CalculateMetadata(totalrecords, filters.Page, filters.PageSize)
+	return results, metadata, nil
+}
+
+// Suggestion is an autocomplete match for a partially typed title.
+type Suggestion struct {
+	ID    int64   `json:"id"`
+	Title string  `json:"title"`
+	Score float32 `json:"score"`
+}
+
+func ValidateAutocomplete(v *validator.Validator, q string, limit int) {
+	v.Check(strings.TrimSpace(q) != "", "q", validator.CodeRequired, nil)
+
+	var maximumQueryLength = 100
+	v.Check(len(q) <= maximumQueryLength, "q", validator.CodeTooLong, validator.Params{"max": maximumQueryLength})
+
+	var maximumSuggestions = 25
+	v.Check(limit > 0 && limit <= maximumSuggestions, "limit", validator.CodeOutOfRange, validator.Params{"min": 1, "max": maximumSuggestions})
+}
+
+// Autocomplete returns the titles closest to what has been typed so far. Word
+// similarity is used rather than whole-string similarity so that "godf" scores
+// well against "The Godfather", and ordering by the <<-> distance lets the
+// trigram GiST index serve the nearest matches directly.
+func (m MovieModel) Autocomplete(ctx context.Context, q string, limit int) (_ []*Suggestion, err error) {
+	query := `
+		SELECT id, title, word_similarity($1, title) AS score
+		FROM movies
+		WHERE $1 <% title
+		ORDER BY $1 <<-> title, id ASC
+		LIMIT $2`
+
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "MovieModel.Autocomplete")
+	defer finish(&err)
+
+	rows, err := m.DB.QueryContext(ctx, query, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*Suggestion{}
+
+	for rows.Next() {
+		var suggestion Suggestion
+
+		err = rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Score)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
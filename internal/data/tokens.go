@@ -6,7 +6,6 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
-	"fmt"
 	"time"
 
 	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
@@ -51,49 +50,50 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlainText string) {
 
-	v.Check(tokenPlainText != "", "token", messageMustProvide)
+	v.Check(tokenPlainText != "", "token", validator.CodeRequired, nil)
 
 	var exactCharAmount = 26
-	v.Check(len(tokenPlainText) == exactCharAmount, "token", fmt.Sprintf("must be exactly %v bytes long", exactCharAmount))
+	v.Check(tokenPlainText == "" || len(tokenPlainText) == exactCharAmount, "token", validator.CodeWrongLength, validator.Params{"length": exactCharAmount})
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	QueryTimeout time.Duration
 }
 
-func (m TokenModel) New(UserID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, UserID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(UserID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) (err error) {
 	query := `
 	INSERT INTO tokens (hash, user_id, expiry, scope)
 	VALUES ($1, $2, $3, $4)
 	`
 	args := []interface{}{token.Hash, token.UsrID, token.Expity, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "TokenModel.Insert")
+	defer finish(&err)
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	_, err = m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (m TokenModel) DeleteForAllUser(scope string, userID int64) error {
+func (m TokenModel) DeleteForAllUser(ctx context.Context, scope string, userID int64) (err error) {
 	query := `
 		DELETE FROM tokens 
 		WHERE scope = $1 and user_id = $2
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "TokenModel.DeleteForAllUser")
+	defer finish(&err)
 
-	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	_, err = m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
@@ -5,7 +5,6 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/3WDeveloper-GM/json-endpoints/internal/validator"
@@ -58,32 +57,31 @@ func (p *password) Matches(Passwd string) (bool, error) {
 	return true, nil
 }
 
-var messageMustProvide = "must provide a value, entry cannot be empty"
-var messageMBAL = "must be at least"
-var messageMNBMT = "must not be more than"
-
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", "email", messageMustProvide)
+	v.Check(email != "", "email", validator.CodeRequired, nil)
 
-	var message = "must be a valid email address"
-	v.Check(validator.Matches(email, validator.EMailMustCompile), "email", message)
+	if email != "" {
+		v.Check(validator.Matches(email, validator.EMailMustCompile), "email", validator.CodeInvalidEmail, nil)
+	}
 }
 
 func ValidatePasswordPlaintext(v *validator.Validator, plaintext string) {
-	v.Check(plaintext != "", "password", messageMustProvide)
+	v.Check(plaintext != "", "password", validator.CodeRequired, nil)
 
 	var minimumPasschar = 8
 	var maximumPasschar = 72
 
-	v.Check(len(plaintext) >= minimumPasschar, "password", fmt.Sprintf(messageMBAL+" %v bytes long.", minimumPasschar))
-	v.Check(len(plaintext) <= maximumPasschar, "password", fmt.Sprintf(messageMNBMT+" %v bytes long.", maximumPasschar))
+	if plaintext != "" {
+		v.Check(len(plaintext) >= minimumPasschar, "password", validator.CodeTooShort, validator.Params{"min": minimumPasschar})
+	}
+	v.Check(len(plaintext) <= maximumPasschar, "password", validator.CodeTooLong, validator.Params{"max": maximumPasschar})
 }
 
 func ValidateUser(v *validator.Validator, usr *User) {
-	v.Check(usr.Name != "", "username", messageMustProvide)
+	v.Check(usr.Name != "", "username", validator.CodeRequired, nil)
 
 	var maximumUsrNameChar = 500
-	v.Check(len(usr.Name) <= maximumUsrNameChar, "username", fmt.Sprintf(messageMNBMT+" %v characters long", messageMNBMT))
+	v.Check(len(usr.Name) <= maximumUsrNameChar, "username", validator.CodeTooLong, validator.Params{"max": maximumUsrNameChar})
 
 	ValidateEmail(v, usr.Email)
 
@@ -99,10 +97,11 @@ func ValidateUser(v *validator.Validator, usr *User) {
 var ErrDuplicateEmail = errors.New("duplicate email")
 
 type UserModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	QueryTimeout time.Duration
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) (err error) {
 	query := `
 		INSERT INTO users (name, email, password_Hash, activated)
 		VALUES ($1, $2, $3, $4)
@@ -111,10 +110,10 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []interface{}{user.Name, user.Email, user.Password.Hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "UserModel.Insert")
+	defer finish(&err)
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -126,7 +125,7 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (_ *User, err error) {
 	query := `
 		SELECT id, created_at, email, password_Hash, activated, version
 		FROM users
@@ -135,10 +134,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "UserModel.GetByEmail")
+	defer finish(&err)
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err = m.DB.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Email,
@@ -159,7 +158,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) (err error) {
 	query := `
 		UPDATE users
 		SET name = $1, email = $2, password_Hash = $3, activated = $4, version = version + 1
@@ -176,10 +175,10 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "UserModel.Update")
+	defer finish(&err)
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&user.Version,
 	)
 	if err != nil {
@@ -195,7 +194,7 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (_ *User, err error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
@@ -212,10 +211,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, finish := queryContext(ctx, m.QueryTimeout, "UserModel.GetForToken")
+	defer finish(&err)
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
@@ -2,9 +2,11 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"html/template"
 
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
 	"github.com/go-mail/mail/v2"
 )
 
@@ -16,7 +18,27 @@ type Mailer struct {
 	Sender string
 }
 
-func (m Mailer) Send(recipient, templatefile string, data interface{}) error {
+// Ping connects and authenticates to the SMTP server without sending anything,
+// to check the server is reachable and the credentials are still accepted.
+func (m Mailer) Ping() error {
+	conn, err := m.Dialer.Dial()
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// Send renders templatefile and delivers it to recipient. The time spent is
+// traced as a child of the span in ctx.
+func (m Mailer) Send(ctx context.Context, recipient, templatefile string, data interface{}) (err error) {
+	_, span := tracing.StartClient(ctx, "Mailer.Send")
+	span.SetAttribute("mail.template", templatefile)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templatefile)
 	if err != nil {
 		return err
@@ -0,0 +1,279 @@
+// Package metrics keeps counters, gauges and histograms in process and renders
+// them in the Prometheus text exposition format, so the API can be scraped
+// without pulling in a client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the output of Registry.WriteTo.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the latency buckets, in seconds, Prometheus clients default to.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+
+	buckets []float64
+	collect func() float64
+}
+
+type series struct {
+	labels []string
+	value  float64
+
+	counts []uint64
+	count  uint64
+}
+
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, found := f.series[key]
+	if !found {
+		s = &series{labels: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Registry holds metric families in the order they were registered.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.families {
+		if existing.name == f.name {
+			panic("metrics: duplicate metric " + f.name)
+		}
+	}
+
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	return f
+}
+
+// CounterVec is a counter split by label values.
+type CounterVec struct{ f *family }
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(&family{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+// Add increases the counter for the given label values by v, which must not
+// be negative.
+func (c *CounterVec) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+
+	s := c.f.get(values)
+
+	c.f.mu.Lock()
+	s.value += v
+	c.f.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// GaugeVec is a value that can go up and down, split by label values.
+type GaugeVec struct{ f *family }
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(&family{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+func (g *GaugeVec) Add(v float64, values ...string) {
+	s := g.f.get(values)
+
+	g.f.mu.Lock()
+	s.value += v
+	g.f.mu.Unlock()
+}
+
+func (g *GaugeVec) Set(v float64, values ...string) {
+	s := g.f.get(values)
+
+	g.f.mu.Lock()
+	s.value = v
+	g.f.mu.Unlock()
+}
+
+func (g *GaugeVec) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+func (g *GaugeVec) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+// HistogramVec counts observations into cumulative buckets, split by label
+// values.
+type HistogramVec struct{ f *family }
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &HistogramVec{r.register(&family{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	s := h.f.get(values)
+
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: "gauge", collect: fn})
+}
+
+// NewCounterFunc registers a counter whose value is read from fn at scrape
+// time, for totals kept elsewhere such as sql.DBStats.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: "counter", collect: fn})
+}
+
+// WriteTo renders every family in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+
+		if f.collect != nil {
+			fmt.Fprintf(bw, "%s %s\n", f.name, formatValue(f.collect()))
+			continue
+		}
+
+		f.mu.Lock()
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+
+			if f.kind != "histogram" {
+				fmt.Fprintf(bw, "%s%s %s\n", f.name, labelPairs(f.labels, s.labels, "", ""), formatValue(s.value))
+				continue
+			}
+
+			for i, bound := range f.buckets {
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", f.name, labelPairs(f.labels, s.labels, "le", formatValue(bound)), s.counts[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", f.name, labelPairs(f.labels, s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", f.name, labelPairs(f.labels, s.labels, "", ""), formatValue(s.value))
+			fmt.Fprintf(bw, "%s_count%s %d\n", f.name, labelPairs(f.labels, s.labels, "", ""), s.count)
+		}
+
+		f.mu.Unlock()
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func labelPairs(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounterVec("requests_total", "Requests.\nBy path.", "path")
+	requests.Inc("/b")
+	requests.Add(2, `/a"quoted"`)
+
+	inflight := registry.NewGaugeVec("in_flight", "In flight.")
+	inflight.Inc()
+	inflight.Inc()
+	inflight.Dec()
+
+	latency := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(3)
+
+	registry.NewGaugeFunc("answer", "Answer.", func() float64 { return 42 })
+
+	var out strings.Builder
+	n, err := registry.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Requests.\nBy path.
+# TYPE requests_total counter
+requests_total{path="/a\"quoted\""} 2
+requests_total{path="/b"} 1
+# HELP in_flight In flight.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.55
+latency_seconds_count 3
+# HELP answer Answer.
+# TYPE answer gauge
+answer 42
+`
+
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	if n != int64(len(want)) {
+		t.Errorf("got %d bytes written, want %d", n, len(want))
+	}
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Requests.", "path", "method")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for missing label values")
+		}
+	}()
+
+	requests.Inc("/only-path")
+}
@@ -0,0 +1,389 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrDirty        = errors.New("database is in a dirty state, fix the failed migration by hand and force the version")
+	ErrNoVersion    = errors.New("unknown migration version")
+	ErrNoDown       = errors.New("missing down migration")
+	ErrBadFileName  = errors.New("migration file names must look like 000001_name.up.sql or 000001_name.down.sql")
+	ErrDuplicateKey = errors.New("duplicate migration file")
+)
+
+// lockKey identifies the advisory lock that keeps concurrent runners, say
+// several replicas booting with -migrate-on-start, from racing each other.
+const lockKey = 7_351_682_043
+
+var fileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration is a numbered pair of SQL scripts. Either script may be empty, in
+// which case applying it only moves the recorded version.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	hasDown bool
+}
+
+// Status is a migration together with whether it is applied to the database.
+type Status struct {
+	Version int64  `json:"version"`
+	Name    string `json:"name"`
+	Applied bool   `json:"applied"`
+	Dirty   bool   `json:"dirty,omitempty"`
+}
+
+// Migrator applies the migrations found in a filesystem to a Postgres
+// database, tracking the current version in the same schema_migrations table
+// golang-migrate uses, so databases migrated by hand keep working.
+type Migrator struct {
+	DB         *sql.DB
+	migrations []*Migration
+}
+
+// New reads every migration in source, usually migrations.FS.
+func New(db *sql.DB, source fs.FS) (*Migrator, error) {
+	migrations, err := Load(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, migrations: migrations}, nil
+}
+
+// Load parses the migration files at the root of source, sorted by version.
+func Load(source fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(source, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		parts := fileName.FindStringSubmatch(entry.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadFileName, entry.Name())
+		}
+
+		version, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadFileName, entry.Name())
+		}
+
+		script, err := fs.ReadFile(source, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, found := byVersion[version]
+		if !found {
+			migration = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = migration
+		}
+
+		if migration.Name != parts[2] {
+			return nil, fmt.Errorf("%w: version %d is used by both %q and %q", ErrDuplicateKey, version, migration.Name, parts[2])
+		}
+
+		switch parts[3] {
+		case "up":
+			migration.Up = string(script)
+		case "down":
+			migration.Down = string(script)
+			migration.hasDown = true
+		}
+	}
+
+	migrations := []*Migration{}
+	for _, migration := range byVersion {
+		migrations = append(migrations, migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Latest returns the highest known migration version, or 0 without any.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	return m.Goto(ctx, m.Latest())
+}
+
+// Down rolls back the given number of applied migrations, or all of them when
+// steps is zero or negative.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	var applied []*Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		version, err := m.checkedVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		target := int64(0)
+		if steps > 0 {
+			position := m.index(version)
+			if position-steps >= 0 {
+				target = m.migrations[position-steps].Version
+			}
+		}
+
+		applied, err = m.migrate(ctx, conn, version, target)
+		return err
+	})
+
+	return applied, err
+}
+
+// Goto migrates up or down until the database is at version. Zero means an
+// empty schema, before the first migration.
+func (m *Migrator) Goto(ctx context.Context, version int64) ([]*Migration, error) {
+	if version != 0 && m.index(version) < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNoVersion, version)
+	}
+
+	var applied []*Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		current, err := m.checkedVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		applied, err = m.migrate(ctx, conn, current, version)
+		return err
+	})
+
+	return applied, err
+}
+
+// Force records version as the current one and clears the dirty flag without
+// running anything, for recovering after a migration failed halfway.
+func (m *Migrator) Force(ctx context.Context, version int64) error {
+	if version != 0 && m.index(version) < 0 {
+		return fmt.Errorf("%w: %d", ErrNoVersion, version)
+	}
+
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		return setVersion(ctx, conn, version, false)
+	})
+}
+
+// Version returns the version recorded in the database and whether the last
+// migration attempt left it dirty.
+func (m *Migrator) Version(ctx context.Context) (int64, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		var err error
+		version, dirty, err = currentVersion(ctx, conn)
+		return err
+	})
+
+	return version, dirty, err
+}
+
+// Status lists every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []Status{}
+	for _, migration := range m.migrations {
+		statuses = append(statuses, Status{
+			Version: migration.Version,
+			Name:    migration.Name,
+			Applied: migration.Version <= version,
+			Dirty:   dirty && migration.Version == version,
+		})
+	}
+
+	return statuses, nil
+}
+
+func (m *Migrator) index(version int64) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// migrate walks from the current version to target one migration at a time.
+// Every step marks the version dirty before running its script and clean after
+// it, so a failure halfway leaves a trace for the next run to refuse on.
+func (m *Migrator) migrate(ctx context.Context, conn *sql.Conn, current, target int64) ([]*Migration, error) {
+	applied := []*Migration{}
+
+	if target >= current {
+		for _, migration := range m.migrations {
+			if migration.Version <= current || migration.Version > target {
+				continue
+			}
+
+			err := run(ctx, conn, migration.Version, migration.Version, migration.Up)
+			if err != nil {
+				return applied, fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return applied, nil
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version > current || migration.Version <= target {
+			continue
+		}
+
+		if !migration.hasDown {
+			return applied, fmt.Errorf("%w: %d_%s", ErrNoDown, migration.Version, migration.Name)
+		}
+
+		previous := int64(0)
+		if i > 0 {
+			previous = m.migrations[i-1].Version
+		}
+
+		err := run(ctx, conn, migration.Version, previous, migration.Down)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+		}
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+func run(ctx context.Context, conn *sql.Conn, dirtyVersion, cleanVersion int64, script string) error {
+	err := setVersion(ctx, conn, dirtyVersion, true)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(script) != "" {
+		_, err = conn.ExecContext(ctx, script)
+		if err != nil {
+			return err
+		}
+	}
+
+	return setVersion(ctx, conn, cleanVersion, false)
+}
+
+// locked runs fn on a single connection holding the migration advisory lock,
+// creating the version table first if it does not exist yet.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey)
+	if err != nil {
+		return err
+	}
+
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) checkedVersion(ctx context.Context, conn *sql.Conn) (int64, error) {
+	version, dirty, err := currentVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if dirty {
+		return 0, fmt.Errorf("%w (version %d)", ErrDirty, version)
+	}
+
+	// A version this binary does not ship, say one recorded by a newer
+	// release, leaves nothing to count steps from or walk down through.
+	if version != 0 && m.index(version) < 0 {
+		return 0, fmt.Errorf("%w: the database is at version %d", ErrNoVersion, version)
+	}
+
+	return version, nil
+}
+
+func currentVersion(ctx context.Context, conn *sql.Conn) (int64, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := conn.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+
+	return version, dirty, err
+}
+
+// setVersion replaces the single row of schema_migrations, a version of zero
+// is stored as no row at all.
+func setVersion(ctx context.Context, conn *sql.Conn, version int64, dirty bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "TRUNCATE schema_migrations")
+	if err != nil {
+		return err
+	}
+
+	if version > 0 {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)", version, dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,167 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/3WDeveloper-GM/json-endpoints/migrations"
+	_ "github.com/lib/pq"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int64
+		err      error
+	}{
+		{
+			name: "sorted pairs",
+			files: fstest.MapFS{
+				"000002_b.up.sql":   {Data: []byte("SELECT 2")},
+				"000001_a.up.sql":   {Data: []byte("SELECT 1")},
+				"000001_a.down.sql": {Data: []byte("")},
+				"README.md":         {Data: []byte("ignored")},
+			},
+			versions: []int64{1, 2},
+		},
+		{
+			name:  "bad name",
+			files: fstest.MapFS{"create_movies.sql": {}},
+			err:   ErrBadFileName,
+		},
+		{
+			name: "reused version",
+			files: fstest.MapFS{
+				"000001_a.up.sql": {},
+				"000001_b.up.sql": {},
+			},
+			err: ErrDuplicateKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded, err := Load(tt.files)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v; want %v", err, tt.err)
+			}
+
+			if len(loaded) != len(tt.versions) {
+				t.Fatalf("got %d migrations; want %d", len(loaded), len(tt.versions))
+			}
+			for i, migration := range loaded {
+				if migration.Version != tt.versions[i] {
+					t.Errorf("migration %d has version %d; want %d", i, migration.Version, tt.versions[i])
+				}
+			}
+		})
+	}
+}
+
+// TestEmbedded guards the shipped migrations: every one must parse and be
+// reversible, since the runner refuses to step down past a missing down file.
+func TestEmbedded(t *testing.T) {
+	loaded, err := Load(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for _, migration := range loaded {
+		if migration.Up == "" || !migration.hasDown || migration.Down == "" {
+			t.Errorf("migration %d_%s is missing its up or down script", migration.Version, migration.Name)
+		}
+	}
+}
+
+// TestUnknownVersion runs against the database in TEST_DB_DSN, in a schema of
+// its own, and is skipped without one. A version missing from the loaded
+// migrations must stop the runner rather than read as "before the first".
+func TestUnknownVersion(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	schema := "migrate_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m, err := New(db, fstest.MapFS{
+		"000001_a.up.sql":   {Data: []byte("CREATE TABLE a (id int)")},
+		"000001_a.down.sql": {Data: []byte("DROP TABLE a")},
+		"000002_b.up.sql":   {Data: []byte("CREATE TABLE b (id int)")},
+		"000002_b.down.sql": {Data: []byte("DROP TABLE b")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// As if a newer release had migrated the database further.
+	if _, err := db.Exec("UPDATE schema_migrations SET version = 3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Down(ctx, 1); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("Down: got error %v; want %v", err, ErrNoVersion)
+	}
+	if _, err := m.Goto(ctx, 1); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("Goto: got error %v; want %v", err, ErrNoVersion)
+	}
+	if _, err := m.Up(ctx); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("Up: got error %v; want %v", err, ErrNoVersion)
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT count(*) FROM information_schema.tables WHERE table_schema = $1 AND table_name IN ('a', 'b')", schema).Scan(&tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 2 {
+		t.Errorf("got %d tables left; want 2, nothing may be rolled back", tables)
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Fallback asks Primary, usually the shared Postgres store, and switches to
+// Secondary for Cooldown whenever Primary fails, so an unreachable store turns
+// the limits into per replica ones instead of failing or stalling requests.
+type Fallback struct {
+	Primary   Limiter
+	Secondary Limiter
+	Cooldown  time.Duration
+
+	// OnError is called with every failure of Primary.
+	OnError func(err error)
+
+	mu      sync.Mutex
+	retryAt time.Time
+	now     func() time.Time
+}
+
+func NewFallback(primary, secondary Limiter, cooldown time.Duration) *Fallback {
+	return &Fallback{Primary: primary, Secondary: secondary, Cooldown: cooldown, now: time.Now}
+}
+
+func (f *Fallback) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	if f.primaryUp() {
+		result, err := f.Primary.Allow(ctx, key, rule)
+		if err == nil {
+			return result, nil
+		}
+
+		// A request that went away is not the store's fault.
+		if ctx.Err() != nil {
+			return Result{}, err
+		}
+
+		f.primaryFailed(err)
+	}
+
+	return f.Secondary.Allow(ctx, key, rule)
+}
+
+// Prune prunes both limiters, since Secondary holds buckets from the last
+// time Primary was down.
+func (f *Fallback) Prune(ctx context.Context) (int, error) {
+	primary, perr := f.Primary.Prune(ctx)
+	secondary, serr := f.Secondary.Prune(ctx)
+
+	return primary + secondary, errors.Join(perr, serr)
+}
+
+func (f *Fallback) primaryUp() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return !f.now().Before(f.retryAt)
+}
+
+func (f *Fallback) primaryFailed(err error) {
+	f.mu.Lock()
+	f.retryAt = f.now().Add(f.Cooldown)
+	f.mu.Unlock()
+
+	if f.OnError != nil {
+		f.OnError(err)
+	}
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyLimiter fails while down is set and otherwise allows everything.
+type flakyLimiter struct {
+	down  bool
+	calls int
+}
+
+func (fl *flakyLimiter) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	fl.calls++
+	if fl.down {
+		return Result{}, errors.New("connection refused")
+	}
+	return Result{Allowed: true, Limit: rule.Burst, Remaining: rule.Burst}, nil
+}
+
+func (fl *flakyLimiter) Prune(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func TestFallback(t *testing.T) {
+	primary := &flakyLimiter{}
+	local, clock := newTestLocal(time.Minute)
+
+	var failures int
+
+	f := NewFallback(primary, local, 10*time.Second)
+	f.now = clock.now
+	f.OnError = func(err error) { failures++ }
+
+	rule := Rule{Rps: 0.001, Burst: 1}
+
+	if got := allow(t, f, "client", rule); !got.Allowed || got.Remaining != 1 {
+		t.Errorf("primary up: got %+v, want the primary's result", got)
+	}
+
+	// While the primary is down the local buckets take over, and the primary
+	// is left alone until the cooldown is over.
+	primary.down = true
+
+	if got := allow(t, f, "client", rule); !got.Allowed {
+		t.Errorf("first local request: got %+v, want it allowed", got)
+	}
+	if got := allow(t, f, "client", rule); got.Allowed {
+		t.Errorf("second local request: got %+v, want it limited", got)
+	}
+
+	if primary.calls != 2 || failures != 1 {
+		t.Errorf("got %d primary calls and %d failures, want 2 and 1", primary.calls, failures)
+	}
+
+	primary.down = false
+	clock.advance(10 * time.Second)
+
+	if got := allow(t, f, "client", rule); !got.Allowed || got.Remaining != 1 {
+		t.Errorf("after cooldown: got %+v, want the primary's result", got)
+	}
+}
+
+func TestFallbackCancelled(t *testing.T) {
+	primary := &flakyLimiter{down: true}
+	local, _ := newTestLocal(time.Minute)
+
+	f := NewFallback(primary, local, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := f.Allow(ctx, "client", Rule{Rps: 1, Burst: 1}); err == nil {
+		t.Fatal("got no error for a cancelled request")
+	}
+
+	if !f.primaryUp() {
+		t.Error("a cancelled request put the primary in cooldown")
+	}
+}
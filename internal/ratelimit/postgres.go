@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/3WDeveloper-GM/json-endpoints/internal/tracing"
+)
+
+// ErrUnsupportedRule is returned by Postgres for rules without a positive
+// rate, which GCRA cannot express.
+var ErrUnsupportedRule = errors.New("ratelimit: rule needs a positive rate and burst")
+
+// DefaultTimeout bounds the queries of a Postgres limiter built without an
+// explicit timeout.
+const DefaultTimeout = 100 * time.Millisecond
+
+// Postgres keeps the buckets in the rate_limits table so every replica draws
+// from the same ones. It implements GCRA: rather than a token count, each key
+// stores its theoretical arrival time (TAT), the moment its bucket is full
+// again, and a request is allowed when pushing the TAT one emission interval
+// further keeps it within burst intervals of now. Time is read from the
+// database, so replicas with skewed clocks still agree.
+type Postgres struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func NewPostgres(db *sql.DB, timeout time.Duration) *Postgres {
+	return &Postgres{DB: db, Timeout: timeout}
+}
+
+// The upsert only moves the TAT when the request is allowed. For rejected
+// requests the second branch reads the TAT as it stood, to tell the client
+// how long to wait.
+const allowQuery = `
+	WITH allowed AS (
+		INSERT INTO rate_limits AS rl (key, tat)
+		VALUES ($1::text, now() + make_interval(secs => $2::float8))
+		ON CONFLICT (key) DO UPDATE
+		SET tat = greatest(rl.tat, now()) + make_interval(secs => $2::float8)
+		WHERE greatest(rl.tat, now()) + make_interval(secs => $2::float8) <= now() + make_interval(secs => $2::float8 * $3::float8)
+		RETURNING tat
+	)
+	SELECT tat, true, now() FROM allowed
+	UNION ALL
+	SELECT tat, false, now() FROM rate_limits
+	WHERE key = $1::text AND NOT EXISTS (SELECT 1 FROM allowed)`
+
+func (p *Postgres) Allow(ctx context.Context, key string, rule Rule) (_ Result, err error) {
+	if rule.Rps <= 0 || rule.Burst < 1 {
+		return Result{}, ErrUnsupportedRule
+	}
+
+	ctx, finish := p.queryContext(ctx, "ratelimit.Allow")
+	defer finish(&err)
+
+	interval := time.Duration(float64(time.Second) / rule.Rps)
+
+	var (
+		tat, now time.Time
+		allowed  bool
+	)
+
+	err = p.DB.QueryRowContext(ctx, allowQuery, key, 1/rule.Rps, rule.Burst).Scan(&tat, &allowed, &now)
+	if err != nil {
+		// The row that caused the conflict was committed after this
+		// statement took its snapshot, so there is no TAT to report.
+		if errors.Is(err, sql.ErrNoRows) {
+			return Result{Limit: rule.Burst, RetryAfter: interval, Reset: interval * time.Duration(rule.Burst)}, nil
+		}
+		return Result{}, err
+	}
+
+	ahead := tat.Sub(now)
+
+	result := Result{Allowed: allowed, Limit: rule.Burst, Reset: max(ahead, 0)}
+	result.Remaining = int(math.Max(0, math.Floor(float64(rule.Burst)-float64(ahead)/float64(interval))))
+
+	if !allowed {
+		result.RetryAfter = max(ahead-time.Duration(rule.Burst-1)*interval, 0)
+	}
+
+	return result, nil
+}
+
+// Prune deletes the buckets that have refilled, which behave exactly like
+// buckets that were never created.
+func (p *Postgres) Prune(ctx context.Context) (_ int, err error) {
+	ctx, finish := p.queryContext(ctx, "ratelimit.Prune")
+	defer finish(&err)
+
+	res, err := p.DB.ExecContext(ctx, `DELETE FROM rate_limits WHERE tat < now()`)
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := res.RowsAffected()
+	return int(removed), err
+}
+
+// queryContext bounds a statement by the store timeout and traces it, the
+// returned finish func records the error the statement ended with.
+func (p *Postgres) queryContext(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, span := tracing.StartClient(ctx, operation)
+	span.SetAttribute("db.system", "postgresql")
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	return ctx, func(err *error) {
+		span.RecordError(*err)
+		cancel()
+		span.End()
+	}
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// TestPostgres runs against the database in TEST_DB_DSN, like the end-to-end
+// tests, and is skipped without one.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// A temporary table shadows any real one, and lives on the only
+	// connection of the pool.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TEMPORARY TABLE rate_limits (key text PRIMARY KEY, tat timestamp with time zone NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	key := "test:" + hex.EncodeToString(suffix)
+
+	p := NewPostgres(db, time.Second)
+	rule := Rule{Rps: 0.001, Burst: 2}
+
+	tests := []struct {
+		allowed   bool
+		remaining int
+	}{
+		{true, 1},
+		{true, 0},
+		{false, 0},
+	}
+
+	for i, tt := range tests {
+		got := allow(t, p, key, rule)
+
+		if got.Allowed != tt.allowed || got.Remaining != tt.remaining || got.Limit != 2 {
+			t.Errorf("request %d: got %+v, want allowed %t with %d remaining", i+1, got, tt.allowed, tt.remaining)
+		}
+
+		if !tt.allowed && (got.RetryAfter < 990*time.Second || got.RetryAfter > 1000*time.Second) {
+			t.Errorf("request %d: got RetryAfter %s, want about 1000s", i+1, got.RetryAfter)
+		}
+	}
+
+	if got := allow(t, p, key+":other", rule); !got.Allowed || got.Remaining != 1 {
+		t.Errorf("other key shares the bucket: got %+v", got)
+	}
+
+	_, err = db.Exec(`UPDATE rate_limits SET tat = now() - interval '1 second' WHERE key = $1`, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := p.Prune(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("got %d buckets removed, want 1", removed)
+	}
+}
@@ -0,0 +1,146 @@
+// Package ratelimit implements the token buckets behind the API rate limiter,
+// either in process memory or shared by every replica through Postgres.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Rule is a token bucket refilled at Rps tokens per second and holding at
+// most Burst tokens.
+type Rule struct {
+	Rps   float64
+	Burst int
+}
+
+// Result describes a decision in the terms of the RateLimit-* headers.
+type Result struct {
+	Allowed bool
+	// Limit is the bucket size.
+	Limit int
+	// Remaining is the number of requests that would be allowed right now.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, zero when
+	// Allowed is true.
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether the request identified by key may go ahead under
+// rule. Buckets are created on the first request for a key and forgotten by
+// Prune once they have been idle long enough to be full again.
+type Limiter interface {
+	Allow(ctx context.Context, key string, rule Rule) (Result, error)
+	Prune(ctx context.Context) (int, error)
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	rule     Rule
+	lastSeen time.Time
+}
+
+// Local keeps one token bucket per key in process memory.
+type Local struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	idle    time.Duration
+	now     func() time.Time
+}
+
+// NewLocal returns buckets that are forgotten after idle without requests.
+// A bucket unused that long has refilled anyway, so dropping it changes no
+// decision.
+func NewLocal(idle time.Duration) *Local {
+	return &Local{
+		buckets: make(map[string]*bucket),
+		idle:    idle,
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key, creating it with rule if this
+// is the first request seen for key. It never fails.
+func (l *Local) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	b, found := l.buckets[key]
+	if !found || b.rule != rule {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(rule.Rps), rule.Burst), rule: rule}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	result := Result{Allowed: b.limiter.AllowN(now, 1), Limit: rule.Burst}
+
+	if !result.Allowed {
+		reservation := b.limiter.ReserveN(now, 1)
+		if reservation.OK() {
+			result.RetryAfter = reservation.DelayFrom(now)
+			reservation.CancelAt(now)
+		}
+	}
+
+	tokens := b.limiter.TokensAt(now)
+	result.Remaining = int(math.Max(0, math.Floor(tokens)))
+	if rule.Rps > 0 {
+		result.Reset = time.Duration((float64(rule.Burst) - tokens) / rule.Rps * float64(time.Second))
+	}
+
+	return result, nil
+}
+
+// Len returns the number of buckets currently held.
+func (l *Local) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.buckets)
+}
+
+// Prune drops the buckets idle for longer than the idle timeout and returns
+// how many it removed.
+func (l *Local) Prune(ctx context.Context) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := l.now().Add(-l.idle)
+	removed := 0
+
+	for key, b := range l.buckets {
+		if b.lastSeen.Before(cutoff) {
+			delete(l.buckets, key)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// Sweep prunes idle buckets from l every interval until ctx is done. Failures
+// are handed to onError, which may be nil, and retried on the next tick.
+func Sweep(ctx context.Context, l Limiter, interval time.Duration, onError func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := l.Prune(ctx)
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
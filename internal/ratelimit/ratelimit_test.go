@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// allow calls l.Allow, which never fails for a Local.
+func allow(t *testing.T, l Limiter, key string, rule Rule) Result {
+	t.Helper()
+
+	result, err := l.Allow(context.Background(), key, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func newTestLocal(idle time.Duration) (*Local, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)}
+
+	l := NewLocal(idle)
+	l.now = clock.now
+
+	return l, clock
+}
+
+func TestAllow(t *testing.T) {
+	l, clock := newTestLocal(time.Minute)
+	rule := Rule{Rps: 1, Burst: 2}
+
+	tests := []struct {
+		advance    time.Duration
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{0, true, 1, time.Second, 0},
+		{0, true, 0, 2 * time.Second, 0},
+		{0, false, 0, 2 * time.Second, time.Second},
+		{500 * time.Millisecond, false, 0, 1500 * time.Millisecond, 500 * time.Millisecond},
+		{500 * time.Millisecond, true, 0, 2 * time.Second, 0},
+		{5 * time.Second, true, 1, time.Second, 0},
+	}
+
+	for i, tt := range tests {
+		clock.advance(tt.advance)
+
+		got := allow(t, l, "client", rule)
+
+		want := Result{Allowed: tt.allowed, Limit: 2, Remaining: tt.remaining, Reset: tt.reset, RetryAfter: tt.retryAfter}
+		if got != want {
+			t.Errorf("request %d: got %+v, want %+v", i+1, got, want)
+		}
+	}
+
+	if got := allow(t, l, "other", rule); !got.Allowed || got.Remaining != 1 {
+		t.Errorf("other key shares the bucket: got %+v", got)
+	}
+}
+
+func TestAllowRuleChange(t *testing.T) {
+	l, _ := newTestLocal(time.Minute)
+
+	allow(t, l, "client", Rule{Rps: 1, Burst: 1})
+
+	got := allow(t, l, "client", Rule{Rps: 1, Burst: 5})
+	if !got.Allowed || got.Limit != 5 || got.Remaining != 4 {
+		t.Errorf("got %+v, want a fresh bucket of 5", got)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	l, clock := newTestLocal(time.Minute)
+	rule := Rule{Rps: 0.001, Burst: 1}
+
+	allow(t, l, "old", rule)
+	clock.advance(45 * time.Second)
+	allow(t, l, "recent", rule)
+	clock.advance(30 * time.Second)
+
+	removed, err := l.Prune(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("got %d buckets removed, want 1", removed)
+	}
+
+	if got := l.Len(); got != 1 {
+		t.Errorf("got %d buckets left, want 1", got)
+	}
+
+	if got := allow(t, l, "recent", rule); got.Allowed {
+		t.Errorf("recent bucket was reset: %+v", got)
+	}
+}
@@ -0,0 +1,293 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriterExporter writes every span as a line of JSON, for reading traces
+// offline from stdout or a file.
+type WriterExporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	closer  io.Closer
+	service string
+}
+
+func NewWriterExporter(w io.Writer, service string) *WriterExporter {
+	return &WriterExporter{w: w, service: service}
+}
+
+// NewFileExporter appends spans to the file at path, creating it if needed.
+func NewFileExporter(path, service string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WriterExporter{w: f, closer: f, service: service}, nil
+}
+
+func (e *WriterExporter) ExportSpan(span SpanData) {
+	line := struct {
+		Service    string                 `json:"service"`
+		TraceID    string                 `json:"trace_id"`
+		SpanID     string                 `json:"span_id"`
+		ParentID   string                 `json:"parent_span_id,omitempty"`
+		Name       string                 `json:"name"`
+		Kind       string                 `json:"kind"`
+		Start      time.Time              `json:"start"`
+		DurationMs float64                `json:"duration_ms"`
+		Attributes map[string]interface{} `json:"attributes,omitempty"`
+		Error      string                 `json:"error,omitempty"`
+	}{
+		Service:    e.service,
+		TraceID:    span.TraceID.String(),
+		SpanID:     span.SpanID.String(),
+		Name:       span.Name,
+		Kind:       span.Kind.String(),
+		Start:      span.Start.UTC(),
+		DurationMs: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+		Attributes: span.Attributes,
+		Error:      span.Error,
+	}
+
+	if span.ParentID != (SpanID{}) {
+		line.ParentID = span.ParentID.String()
+	}
+
+	js, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.w.Write(append(js, '\n'))
+}
+
+func (e *WriterExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+func (k SpanKind) String() string {
+	switch k {
+	case KindServer:
+		return "server"
+	case KindClient:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector using the
+// OTLP/HTTP JSON encoding. Spans are queued and dropped, never waited on, when
+// the collector cannot keep up.
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	queue chan SpanData
+	flush chan chan struct{}
+	once  sync.Once
+
+	// OnError is called with failures to reach the collector.
+	OnError func(err error)
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpQueueSize     = 4096
+	otlpFlushInterval = 5 * time.Second
+)
+
+// NewOTLPExporter starts the background sender. endpoint is the collector
+// base URL, such as http://localhost:4318, to which /v1/traces is appended.
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan SpanData, otlpQueueSize),
+		flush:    make(chan chan struct{}),
+	}
+
+	go e.run()
+
+	return e
+}
+
+func (e *OTLPExporter) ExportSpan(span SpanData) {
+	select {
+	case e.queue <- span:
+	default:
+	}
+}
+
+// Shutdown sends what is still queued, waiting at most until ctx is done.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	flushed := make(chan struct{})
+
+	e.once.Do(func() {
+		select {
+		case e.flush <- flushed:
+		case <-ctx.Done():
+		}
+	})
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, otlpBatchSize)
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := e.send(batch)
+		if err != nil && e.OnError != nil {
+			e.OnError(err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) == otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+				if len(batch) == otlpBatchSize {
+					send()
+				}
+			}
+			send()
+			close(flushed)
+			return
+		}
+	}
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attributes))
+
+	for key, value := range attributes {
+		var v map[string]interface{}
+
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+
+		out = append(out, otlpAttribute{Key: key, Value: v})
+	}
+
+	return out
+}
+
+func (e *OTLPExporter) send(batch []SpanData) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+
+	for _, span := range batch {
+		otlp := map[string]interface{}{
+			"traceId":           span.TraceID.String(),
+			"spanId":            span.SpanID.String(),
+			"name":              span.Name,
+			"kind":              int(span.Kind),
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes),
+		}
+
+		if span.ParentID != (SpanID{}) {
+			otlp["parentSpanId"] = span.ParentID.String()
+		}
+
+		if span.Error != "" {
+			otlp["status"] = map[string]interface{}{"code": 2, "message": span.Error}
+		}
+
+		spans = append(spans, otlp)
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": e.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/3WDeveloper-GM/json-endpoints/internal/tracing"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("otlp collector responded %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,292 @@
+// Package tracing records spans for requests, queries and emails and
+// propagates them with W3C traceparent headers. Spans are handed to an
+// Exporter once they end; until SetExporter is called every operation is a
+// cheap no-op, so instrumented code needs no checks of its own.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent reads a traceparent header value. Unknown future versions
+// are accepted as long as they start with the version 00 fields, as the W3C
+// specification asks.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+// Extract returns the span context carried by the traceparent header of h.
+func Extract(h http.Header) (SpanContext, bool) {
+	return ParseTraceparent(h.Get("traceparent"))
+}
+
+// Inject sets the traceparent header of h to continue the span in ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if span := FromContext(ctx); span != nil {
+		h.Set("traceparent", span.context.Traceparent())
+	}
+}
+
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Span is one timed operation. A nil *Span is valid and ignores every call,
+// which is what Start returns while tracing is disabled.
+type Span struct {
+	context SpanContext
+	parent  SpanID
+	name    string
+	kind    SpanKind
+	start   time.Time
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+// Context returns the identifiers of the span, the zero value for a nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetName replaces the span name, for names only known once the work is
+// done, like the route pattern of a request.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute records a string, bool, integer or floating point value.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End stops the clock and hands the span to the exporter. Calls after the
+// first are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	end := time.Now()
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+
+	data := SpanData{
+		TraceID:    s.context.TraceID,
+		SpanID:     s.context.SpanID,
+		ParentID:   s.parent,
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      s.start,
+		End:        end,
+		Attributes: s.attributes,
+		Error:      s.err,
+	}
+	s.mu.Unlock()
+
+	if !s.context.Sampled {
+		return
+	}
+
+	if t := current.Load(); t != nil {
+		t.exporter.ExportSpan(data)
+	}
+}
+
+// SpanData is a finished span as exporters see it.
+type SpanData struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Name       string
+	Kind       SpanKind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+// Exporter ships finished spans somewhere. ExportSpan must not block for
+// long since it runs on the request path.
+type Exporter interface {
+	ExportSpan(span SpanData)
+	Shutdown(ctx context.Context) error
+}
+
+type tracer struct {
+	exporter Exporter
+}
+
+var current atomic.Pointer[tracer]
+
+// SetExporter turns tracing on, or off again with a nil exporter.
+func SetExporter(exporter Exporter) {
+	if exporter == nil {
+		current.Store(nil)
+		return
+	}
+	current.Store(&tracer{exporter: exporter})
+}
+
+// Shutdown flushes the spans the exporter still holds and disables tracing.
+func Shutdown(ctx context.Context) error {
+	t := current.Swap(nil)
+	if t == nil {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+// Enabled reports whether an exporter is installed.
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+type contextKey struct{}
+
+// FromContext returns the span ctx carries, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+// Start begins a span as a child of the one in ctx, or as the root of a new
+// trace, and returns a context carrying it.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, KindInternal, SpanContext{})
+}
+
+// StartClient begins a span for a call to another service, such as a query.
+func StartClient(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, KindClient, SpanContext{})
+}
+
+// StartServer begins the span of an incoming request, continuing remote when
+// it is valid.
+func StartServer(ctx context.Context, name string, remote SpanContext) (context.Context, *Span) {
+	return start(ctx, name, KindServer, remote)
+}
+
+func start(ctx context.Context, name string, kind SpanKind, remote SpanContext) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+
+	span := &Span{name: name, kind: kind, start: time.Now()}
+
+	parent := remote
+	if !parent.IsValid() {
+		parent = FromContext(ctx).Context()
+	}
+
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+
+	return context.WithValue(ctx, contextKey{}, span), span
+}
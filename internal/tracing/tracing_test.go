@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		valid   bool
+		sampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"version 00 with extra field", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"forbidden version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false, false},
+		{"empty", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.value)
+			if ok != tt.valid {
+				t.Fatalf("got valid %v, want %v", ok, tt.valid)
+			}
+			if !ok {
+				return
+			}
+
+			if sc.Sampled != tt.sampled {
+				t.Errorf("got sampled %v, want %v", sc.Sampled, tt.sampled)
+			}
+
+			if tt.value[:2] == "00" && sc.Traceparent() != tt.value {
+				t.Errorf("round trip gave %q", sc.Traceparent())
+			}
+		})
+	}
+}
+
+type recorder struct{ spans []SpanData }
+
+func (r *recorder) ExportSpan(span SpanData) { r.spans = append(r.spans, span) }
+
+func (r *recorder) Shutdown(ctx context.Context) error { return nil }
+
+func TestSpanHierarchy(t *testing.T) {
+	ctx, span := Start(context.Background(), "disabled")
+	if span != nil || FromContext(ctx) != nil {
+		t.Fatal("spans started while tracing is disabled")
+	}
+	span.SetAttribute("ignored", true)
+	span.End()
+
+	rec := &recorder{}
+	SetExporter(rec)
+	defer SetExporter(nil)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, root := StartServer(context.Background(), "GET /", remote)
+	_, child := StartClient(ctx, "query")
+	child.End()
+	child.End()
+	root.End()
+
+	if len(rec.spans) != 2 {
+		t.Fatalf("got %d spans exported, want 2", len(rec.spans))
+	}
+
+	query, request := rec.spans[0], rec.spans[1]
+
+	if request.TraceID != remote.TraceID || request.ParentID != remote.SpanID {
+		t.Errorf("server span does not continue the remote trace")
+	}
+	if query.TraceID != remote.TraceID || query.ParentID != request.SpanID {
+		t.Errorf("client span is not a child of the server span")
+	}
+
+	unsampled, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span = StartServer(context.Background(), "GET /", unsampled)
+	span.End()
+
+	if len(rec.spans) != 2 {
+		t.Error("unsampled span was exported")
+	}
+}
@@ -0,0 +1,106 @@
+package validator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultLocale is used for requests whose Accept-Language matches no locale
+// in the catalog, and for messages a locale has no translation of.
+const DefaultLocale = "en"
+
+// catalog holds the message of every error code per locale. Messages refer to
+// the parameters of the error as {name}.
+var catalog = map[string]map[string]string{
+	"en": {
+		CodeRequired:          "must be provided",
+		CodeTooShort:          "must be at least {min} bytes long",
+		CodeTooLong:           "must not be more than {max} bytes long",
+		CodeWrongLength:       "must be exactly {length} bytes long",
+		CodeTooMany:           "must not contain more than {max} values",
+		CodeOutOfRange:        "must be between {min} and {max}",
+		CodeTooSmall:          "must be at least {min}",
+		CodeGreaterThanField:  "must not be greater than {field}",
+		CodeNotBefore:         "must be earlier than {field}",
+		CodeNotUnique:         "must not contain duplicate values",
+		CodeAlreadyExists:     "is already in use",
+		CodeNotAllowed:        "{value} is not supported, must be one of {allowed}",
+		CodeInvalidEmail:      "must be a valid email address",
+		CodeInvalidCharacters: "must only contain visible ASCII characters",
+		CodeNotInteger:        "must be an integer value",
+		CodeNotBoolean:        "must be a boolean value",
+		CodeInvalidTime:       "must be an RFC 3339 timestamp or a YYYY-MM-DD date",
+		CodeNoTerms:           "must contain at least one word",
+		CodeInvalidCursor:     "is invalid or has been tampered with",
+		CodeCursorMismatch:    "was issued for a different sort, keep the same sort parameter while paging",
+		CodeInvalidToken:      "is invalid or has expired",
+	},
+	"es": {
+		CodeRequired:          "es obligatorio",
+		CodeTooShort:          "debe tener al menos {min} bytes",
+		CodeTooLong:           "no debe tener más de {max} bytes",
+		CodeWrongLength:       "debe tener exactamente {length} bytes",
+		CodeTooMany:           "no debe contener más de {max} valores",
+		CodeOutOfRange:        "debe estar entre {min} y {max}",
+		CodeTooSmall:          "debe ser al menos {min}",
+		CodeGreaterThanField:  "no debe ser mayor que {field}",
+		CodeNotBefore:         "debe ser anterior a {field}",
+		CodeNotUnique:         "no debe contener valores repetidos",
+		CodeAlreadyExists:     "ya está en uso",
+		CodeNotAllowed:        "{value} no está permitido, debe ser uno de {allowed}",
+		CodeInvalidEmail:      "debe ser una dirección de correo electrónico válida",
+		CodeInvalidCharacters: "solo debe contener caracteres ASCII visibles",
+		CodeNotInteger:        "debe ser un número entero",
+		CodeNotBoolean:        "debe ser un valor booleano",
+		CodeInvalidTime:       "debe ser una marca de tiempo RFC 3339 o una fecha AAAA-MM-DD",
+		CodeNoTerms:           "debe contener al menos una palabra",
+		CodeInvalidCursor:     "no es válido o ha sido alterado",
+		CodeCursorMismatch:    "se emitió para otro orden, mantén el mismo parámetro sort al paginar",
+		CodeInvalidToken:      "no es válido o ha caducado",
+	},
+}
+
+// Locales lists the locales of the catalog, the default first.
+func Locales() []string {
+	return []string{DefaultLocale, "es"}
+}
+
+// Message renders the error in locale, falling back to DefaultLocale and, for
+// codes missing from the catalog altogether, to the code itself.
+func (e FieldError) Message(locale string) string {
+	template, ok := catalog[locale][e.Code]
+	if !ok {
+		template, ok = catalog[DefaultLocale][e.Code]
+	}
+	if !ok {
+		return e.Code
+	}
+
+	if len(e.Params) == 0 {
+		return template
+	}
+
+	replacements := make([]string, 0, 2*len(e.Params))
+	for name, value := range e.Params {
+		replacements = append(replacements, "{"+name+"}", formatParam(value))
+	}
+
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// formatParam writes strings quoted, so a rejected value stands out from the
+// message around it, and lists of them comma separated.
+func formatParam(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return fmt.Sprintf("%q", value)
+	case []string:
+		quoted := make([]string, len(value))
+		for i, s := range value {
+			quoted[i] = fmt.Sprintf("%q", s)
+		}
+		return strings.Join(quoted, ", ")
+	default:
+		return fmt.Sprint(value)
+	}
+}
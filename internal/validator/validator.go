@@ -6,27 +6,63 @@ import (
 
 var EMailMustCompile = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+// Error codes are part of the API, clients match on them to translate or
+// react to validation failures, so existing codes must never change meaning.
+const (
+	CodeRequired          = "required"
+	CodeTooShort          = "too_short"
+	CodeTooLong           = "too_long"
+	CodeWrongLength       = "wrong_length"
+	CodeTooMany           = "too_many"
+	CodeOutOfRange        = "out_of_range"
+	CodeTooSmall          = "too_small"
+	CodeGreaterThanField  = "greater_than_field"
+	CodeNotBefore         = "not_before"
+	CodeNotUnique         = "not_unique"
+	CodeAlreadyExists     = "already_exists"
+	CodeNotAllowed        = "not_allowed"
+	CodeInvalidEmail      = "invalid_email"
+	CodeInvalidCharacters = "invalid_characters"
+	CodeNotInteger        = "not_integer"
+	CodeNotBoolean        = "not_boolean"
+	CodeInvalidTime       = "invalid_time"
+	CodeNoTerms           = "no_terms"
+	CodeInvalidCursor     = "invalid_cursor"
+	CodeCursorMismatch    = "cursor_mismatch"
+	CodeInvalidToken      = "invalid_token"
+)
+
+// Params are the values an error message refers to, like the bounds of an
+// out_of_range error.
+type Params map[string]interface{}
+
+// FieldError is one validation failure of a field.
+type FieldError struct {
+	Code   string `json:"code"`
+	Params Params `json:"params,omitempty"`
+}
+
 type Validator struct {
-	Errors map[string]string
+	Errors map[string][]FieldError
 }
 
 func NewValidator() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{Errors: make(map[string][]FieldError)}
 }
 
 func (v *Validator) Valid() bool {
 	return len(v.Errors) == 0
 }
 
-func (v *Validator) AddError(key, message string) {
-	if _, exists := v.Errors[key]; !exists {
-		v.Errors[key] = message
-	}
+// AddError records a failure of the field key. A field can fail several
+// checks, every one of them is kept in the order it was added.
+func (v *Validator) AddError(key, code string, params Params) {
+	v.Errors[key] = append(v.Errors[key], FieldError{Code: code, Params: params})
 }
 
-func (v *Validator) Check(ok bool, key, message string) {
+func (v *Validator) Check(ok bool, key, code string, params Params) {
 	if !ok {
-		v.AddError(key, message)
+		v.AddError(key, code, params)
 	}
 }
 
@@ -0,0 +1,55 @@
+package validator
+
+import "testing"
+
+func TestAddErrorKeepsEveryFailure(t *testing.T) {
+	v := NewValidator()
+
+	v.Check(false, "genres", CodeTooMany, Params{"max": 5})
+	v.Check(true, "genres", CodeRequired, nil)
+	v.Check(false, "genres", CodeNotUnique, nil)
+
+	if v.Valid() {
+		t.Fatal("got valid, want invalid")
+	}
+
+	errs := v.Errors["genres"]
+	if len(errs) != 2 || errs[0].Code != CodeTooMany || errs[1].Code != CodeNotUnique {
+		t.Errorf("got %+v, want too_many then not_unique", errs)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    FieldError
+		locale string
+		want   string
+	}{
+		{"plain", FieldError{Code: CodeRequired}, "en", "must be provided"},
+		{"translated", FieldError{Code: CodeRequired}, "es", "es obligatorio"},
+		{"params", FieldError{Code: CodeOutOfRange, Params: Params{"min": 1, "max": 100}}, "en", "must be between 1 and 100"},
+		{"translated params", FieldError{Code: CodeOutOfRange, Params: Params{"min": 1, "max": 100}}, "es", "debe estar entre 1 y 100"},
+		{"list", FieldError{Code: CodeNotAllowed, Params: Params{"value": "xml", "allowed": []string{"csv", "json"}}}, "en", `"xml" is not supported, must be one of "csv", "json"`},
+		{"unknown locale", FieldError{Code: CodeRequired}, "fr", "must be provided"},
+		{"unknown code", FieldError{Code: "made_up"}, "en", "made_up"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Message(tt.locale); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatalogComplete(t *testing.T) {
+	for _, locale := range Locales() {
+		for code := range catalog[DefaultLocale] {
+			if _, ok := catalog[locale][code]; !ok {
+				t.Errorf("locale %s has no message for %s", locale, code)
+			}
+		}
+	}
+}
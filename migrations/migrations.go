@@ -0,0 +1,8 @@
+// Package migrations embeds the SQL migrations so the binaries can apply them
+// without the files being shipped alongside.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS